@@ -19,67 +19,294 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"container/list"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io"
+	"maps"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/godbus/dbus/v5"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/time/rate"
 )
 
 const (
 	socketName    = "define.sock"
 	appName       = "define"
 	apiTimeout    = 900 * time.Millisecond
+	apiTimeoutMax = 10 * time.Second
+	dialTimeout   = 300 * time.Millisecond
+	userAgent     = "define/1.0 (go)"
 	cmdTimeout    = 180 * time.Millisecond
 	daemonReadMax = 4096
 
-	maxWordLen   = 64
-	memCacheMax  = 2500
-	cacheTTL     = 30 * 24 * time.Hour
-	dedupeWindow = 250 * time.Millisecond
+	lookupsDefault  = 4                       // concurrent lookups in the daemon
+	lookupQueueWait = 1500 * time.Millisecond // how long a connection waits for a slot
 
-	bodyMaxChars = 1400
+	maxWordLen       = 64
+	memCacheMax      = 2500
+	diskCacheMax     = 10000               // DEFINE_CACHE_MAX; the oldest entries go past this
+	cacheTTL         = 30 * 24 * time.Hour // DEFINE_CACHE_TTL, within cacheTTLMin..cacheTTLMax
+	cacheTTLMin      = time.Hour
+	cacheTTLMax      = 365 * 24 * time.Hour
+	negativeTTL      = 10 * time.Minute       // "none" results, so typos don't stick
+	dedupeWindow     = 250 * time.Millisecond // DEFINE_DEDUPE_WINDOW, at most dedupeWindowMax
+	dedupeWindowMax  = 10 * time.Second
+	dedupePruneEvery = time.Minute
 
-	primaryAPI    = "https://api.dictionaryapi.dev/api/v2/entries/en/%s"
-	wiktionaryAPI = "https://en.wiktionary.org/api/rest_v1/page/definition/%s"
+	// With dnd = "queue", held-back notifications are shown once
+	// do-not-disturb ends, which is checked every dndPoll.
+	dndQueueMax = 5
+	dndPoll     = 5 * time.Second
+
+	spawnWait = 2 * time.Second // --autospawn: how long a new daemon gets to listen
+
+	bodyMaxChars = 1400 // DEFINE_BODY_MAX, within bodyMaxMin..bodyMaxMax
+	bodyMaxMin   = 200
+	bodyMaxMax   = 8000
+
+	meaningsDefault = 3  // dictionaryapi.dev / Merriam-Webster senses shown; DEFINE_MAX_MEANINGS
+	defsDefault     = 7  // Wiktionary definitions shown; DEFINE_MAX_DEFS
+	examplesDefault = 1  // dictionaryapi.dev example sentences per meaning; examples in config.toml
+	limitMax        = 20 // cap for both, since the body is clamped anyway
+	noExamples      = -1 // examples = 0 in config.toml; a 0 count means the default
+
+	historyDefault  = 20
+	historyMaxBytes = 1 << 20 // roughly 10k lines; the older half is dropped past this
+	missesMax       = 500     // misses.txt keeps the newest this many words
+
+	// selectionTrim is the punctuation stripped from the ends of a selection.
+	// Hyphens and dashes only go at the ends ("-well-known—" → "well-known").
+	selectionTrim = " \t\r\n\"“”‘’.,;:!?()[]{}-‐–—"
+
+	defaultLang = "en"
+
+	raceGrace        = 150 * time.Millisecond
+	thesaurusTimeout = 400 * time.Millisecond
+	thesaurusMax     = 5
+	suggestTimeout   = 400 * time.Millisecond
+	suggestMax       = 3
+	meansMax         = 8   // --means candidates listed in the full view
+	meansShown       = 4   // of which the notification shows this many
+	meansMaxLen      = 200 // longest --means description sent to Datamuse
+	etymologyTimeout = 400 * time.Millisecond
 
-	offlineRefreshAfter = 12 * time.Hour
+	offlineRefreshAfter = 12 * time.Hour // DEFINE_OFFLINE_REFRESH, from a minute up to cacheTTLMax
+	offlineRefreshMin   = time.Minute
+	compactEvery        = time.Hour // the daemon drops expired disk entries this often
+
+	retryAfterMax = 400 * time.Millisecond
+
+	rateDefault = 5 // requests per second per API host; DEFINE_RATE_LIMIT
+
+	// An online source that fails breakerThreshold times within
+	// breakerWindow is skipped for breakerCooldown, then probed again.
+	breakerThreshold = 3
+	breakerWindow    = 30 * time.Second
+	breakerCooldown  = time.Minute
+
+	// Exit codes for scripts (--quiet, --json).
+	exitNotFound    = 3  // no source had a definition
+	exitNoInput     = 2  // nothing valid to look up
+	exitUsage       = 64 // bad command line (EX_USAGE)
+	exitUnavailable = 69 // no source could be reached (EX_UNAVAILABLE)
+
+	// Control messages sent over the socket. They are matched before
+	// pickWord/validWord, which would otherwise accept them as words.
+	ctrlStop    = "__STOP__"    // --stop
+	ctrlClear   = "__CLEAR__"   // --clear-cache; the daemon replies with the entry count
+	ctrlStatus  = "__STATUS__"  // --status; the daemon replies with daemonStatus JSON
+	ctrlCompact = "__COMPACT__" // --clear-cache --expired-only; replies with the pruned count
 )
 
 var (
-	wordRe         = regexp.MustCompile(`^[\w\-']+$`)
+	wordRe         = regexp.MustCompile(`^[\p{L}\p{M}\d_\-']+$`) // letters in any script, including "café"
+	phraseRe       = regexp.MustCompile(`^[\p{L}\p{M}\d_\-']+(?: [\p{L}\p{M}\d_\-']+)*$`)
 	wsCollapseRe   = regexp.MustCompile(`\s+`)
 	bracketTagRe   = regexp.MustCompile(`\s*\[[^\]]+\]`)          // removes [PJC], [1913 Webster], etc.
 	dbHeaderLineRe = regexp.MustCompile(`^[A-Za-z0-9_-]+:\s+.+$`) // "gcide: Legend"
+	dbNameRe       = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	wnSenseRe      = regexp.MustCompile(`^(?:n|v|adj|adv)\s*\d*\s*:`) // WordNet "n 1: ..."
+	htmlTagRe      = regexp.MustCompile(`<[^>]*>`)
+	lineHyphenRe   = regexp.MustCompile(`(\p{L})[-‐][ \t]*\r?\n\s*(\p{L})`)
+	wiktLabelRe    = regexp.MustCompile(`<span class="ib-content"[^>]*>(.*?)</span>`) // "(informal)" sense labels
+	reqHeaderRe    = regexp.MustCompile(`^([a-z-]+): *(.*)$`)                         // "lang: es" in a daemon request
+)
+
+// version is set at build time: go build -ldflags "-X main.version=v0.2.0".
+var version = "dev"
+
+// API URL formats. They are variables only so tests can point them at an
+// httptest.Server.
+var (
+	primaryAPI    = "https://api.dictionaryapi.dev/api/v2/entries/%s/%s"
+	wiktionaryAPI = "https://en.wiktionary.org/api/rest_v1/page/definition/%s"
+	mwAPI         = "https://www.dictionaryapi.com/api/v3/references/collegiate/json/%s?key=%s"
+	datamuseAPI   = "https://api.datamuse.com/words?%s=%s&max=%d"
+	extractAPI    = "https://en.wiktionary.org/w/api.php?action=query&prop=extracts&explaintext=1&redirects=1&format=json&titles=%s"
 )
 
+// defaultDictDBs is the offline database order when DEFINE_DICT_DBS is unset.
+var defaultDictDBs = []string{"gcide"}
+
+// retryBackoff is the wait before each retry of a transient API failure;
+// its length is the number of retries.
+var retryBackoff = []time.Duration{100 * time.Millisecond, 250 * time.Millisecond}
+
+// supportedLangs are the language codes accepted by --lang. The Wiktionary
+// definition endpoint is only served by en.wiktionary, but its payload is
+// keyed by language code, so the same codes select the section to read.
+var supportedLangs = map[string]bool{
+	"en": true, "es": true, "fr": true, "de": true, "it": true,
+	"pt": true, "ru": true, "ja": true, "ko": true, "hi": true,
+	"ar": true, "tr": true,
+}
+
+// partsOfSpeech are the values accepted by --pos.
+var partsOfSpeech = map[string]bool{
+	"noun": true, "verb": true, "adjective": true, "adverb": true,
+	"pronoun": true, "preposition": true, "conjunction": true,
+	"interjection": true, "determiner": true,
+}
+
 type config struct {
 	debug       bool
+	version     bool
+	help        bool
 	daemon      bool
+	watch       bool // --watch (with --daemon): define each new PRIMARY selection
+	noDaemon    bool
 	forceOnline bool
 	noOffline   bool
+	offlineOnly bool // --offline-only: never touch the network
 	fullView    bool
+	last        bool // --last: show the previous lookup's notification again
+	stop        bool
+	clearCache  bool
+	expiredOnly bool // with --clear-cache: only drop expired entries
+	json        bool
+	quiet       bool // --quiet: no output or notification, only the exit code
+	dryRun      bool // --dry-run: report the lookup plan, fetch nothing
+	phrase      bool
+	wordIndex   int    // --word-index: which word of the selection to define
+	metricsAddr string // --metrics-addr: where the daemon serves /metrics
+	random      bool
+	noThesaurus bool
+	noEtymology bool
+	warmUp      bool // direct mode: pre-connect to the extras' hosts during the lookup
+	race        bool
+	stem        bool // --stem: also try the Porter stem, after the lemma candidates
+	sound       bool // --sound: ask the notification server to play a sound
+	soundFound  string
+	soundNone   string
+	allSources  bool // --all-sources: the full view lists every source's answer
+	status      bool
+	history     int           // --history[=N]: print the last N lookups
+	misses      bool          // --misses: print the words no source could define
+	repl        bool          // --repl: define each line of stdin until EOF
+	save        bool          // --save: bookmark the word as well as showing it
+	bookmarks   bool          // --bookmarks: list the saved words
+	search      bool          // --search: list cached words whose definition mentions the args
+	review      bool          // --review: show the bookmark due for review
+	export      string        // --export: anki or csv
+	exportFrom  string        // --export-from: cache (default) or bookmarks
+	exportSrcs  []string      // --export-source: only entries from these sources
+	since       time.Duration // --since: only entries fetched/saved this recently
+	anyLang     bool          // --any-lang: Wiktionary may answer from another language's section
+	sequential  bool          // --sequential: try candidates one at a time, not at once
+	means       bool          // --means: find words for the description given
+	autospawn   bool          // --autospawn: start a daemon when none is running
+	noMarkup    bool          // --no-markup: send the notification body as plain text
+	clipboard   bool          // --clipboard: read the regular clipboard before PRIMARY
+	titleFormat string        // DEFINE_TITLE_FORMAT / title_format, see formatTitle
+	dnd         string        // dnd: what the daemon does in do-not-disturb: show, suppress or queue
+	lang        string
+	pos         string        // --pos: only show senses for this part of speech
+	sources     []string      // lookup order; nil means defaultSources
+	expire      time.Duration // notification expire_timeout; 0 means never
+	maxMeanings int           // per-source result counts, from the environment; 0 means the default
+	maxDefs     int
+	maxExamples int // from config.toml; noExamples for none
+	bodyMax     int // notification body length, from the environment
+}
+
+// defaultSources is the lookup order when the config file doesn't set one.
+// Sources that can't run (mw without a key, offline with --no-offline) are skipped.
+var defaultSources = []string{"custom", "mw", "online", "wiktionary", "offline"}
+
+// sourceRegistry maps each source name usable in the order to its adapter.
+var sourceRegistry = map[string]func(lookupEnv) dictSource{
+	"custom":     func(e lookupEnv) dictSource { return customSource{e} },
+	"mw":         func(e lookupEnv) dictSource { return mwSource{e} },
+	"online":     func(e lookupEnv) dictSource { return primarySource{e} },
+	"wiktionary": func(e lookupEnv) dictSource { return wiktionarySource{e} },
+	"offline":    func(e lookupEnv) dictSource { return offlineSource{e} },
 }
 
 type paths struct {
 	wlPaste string
+	wlCopy  string
+	xclip   string
+	xsel    string
 	dict    string
 	zenity  string
+	kdialog string // full-view fallbacks after zenity
+	yad     string
+	xterm   string
+	player  string // mpv, ffplay, pw-play or paplay
+	xdgOpen string // opens web pages in the browser
+
+	dunstctl  string // do-not-disturb probes, see dndActive
+	makoctl   string
+	swaync    string
+	gsettings string
 }
 
 func main() {
-	cfg := parseArgs(os.Args[1:])
+	cfg, err := parseArgs(loadConfig(), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "define: %v\n\n%s", err, usage)
+		os.Exit(exitUsage)
+	}
+	if cfg.help {
+		fmt.Print(usage)
+		return
+	}
+	if cfg.version {
+		printVersion()
+		return
+	}
 	ensureCommonPATH()
 	p := resolvePaths()
 
@@ -88,43 +315,605 @@ func main() {
 		return
 	}
 
+	if cfg.last {
+		os.Exit(showLast(cfg, p))
+	}
+
+	if cfg.stop {
+		if _, err := sendControl(ctrlStop); err != nil {
+			fmt.Fprintln(os.Stderr, "define: daemon not running:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.clearCache {
+		if cfg.expiredOnly {
+			os.Exit(compactCache())
+		}
+		os.Exit(clearCache())
+	}
+
+	if cfg.status {
+		os.Exit(printStatus())
+	}
+
+	if cfg.history > 0 {
+		os.Exit(printHistory(cfg.history))
+	}
+
+	if cfg.misses {
+		os.Exit(printMisses())
+	}
+
+	if cfg.bookmarks {
+		os.Exit(printBookmarks())
+	}
+
+	if cfg.export != "" {
+		os.Exit(exportEntries(cfg, os.Stdout))
+	}
+
+	if cfg.search {
+		q := strings.Join(filterOutFlags(os.Args[1:]), " ")
+		if strings.TrimSpace(q) == "" {
+			fmt.Fprintln(os.Stderr, "define: --search needs some text to look for")
+			os.Exit(exitUsage)
+		}
+		os.Exit(searchCache(q, os.Stdout))
+	}
+
+	if cfg.review {
+		os.Exit(reviewBookmark(cfg, p))
+	}
+
 	if cfg.daemon {
 		os.Exit(runDaemon(cfg, p))
 	}
 
+	if cfg.repl {
+		os.Exit(runREPL(cfg, p, os.Stdin, os.Stdout))
+	}
+
+	if cfg.means {
+		os.Exit(defineByMeaning(cfg, p, filterOutFlags(os.Args[1:])))
+	}
+
+	pick := func(s string) string { return pickNthWord(s, cfg.wordIndex) }
+	valid := validWord
+	if cfg.phrase {
+		pick, valid = pickPhrase, validPhrase
+	}
+
 	word := ""
 	args := filterOutFlags(os.Args[1:])
-	if len(args) > 0 {
-		word = pickWord(strings.Join(args, " "))
+	if cfg.random {
+		word = randomWord(loadDiskCache(cacheFilePath()))
+	} else if len(args) > 0 {
+		word = pick(strings.Join(args, " "))
+		// A typed word that is too long gets told why nothing happens; a
+		// long selection is usually a stray drag, so that stays silent.
+		if len(word) > maxWordLen {
+			reportTooLong(cfg, p, word)
+		}
 	} else {
-		word = pickWord(getSelectedTextWayland(cfg, p))
+		word = pick(getSelectedText(cfg, p))
+	}
+	if !valid(word) {
+		if cfg.json || cfg.quiet || cfg.dryRun {
+			os.Exit(exitNoInput)
+		}
+		return
+	}
+
+	if cfg.dryRun {
+		os.Exit(printDryRun(cfg, p, word))
+	}
+
+	if cfg.save {
+		os.Exit(saveWord(cfg, p, word))
 	}
-	if !validWord(word) {
+
+	if cfg.json {
+		os.Exit(printJSON(cfg, p, word))
+	}
+
+	if cfg.quiet {
+		os.Exit(exitCode(resolveDirect(cfg, p, word).Source))
+	}
+
+	os.Exit(exitCode(clientSend(cfg, word)))
+}
+
+// reportTooLong says why a typed word isn't looked up: on stderr from a
+// terminal or for --json/--quiet/--dry-run, else (a keybind running
+// "define <word>") as a notification.
+func reportTooLong(cfg config, p paths, word string) {
+	msg := fmt.Sprintf("%q is too long to look up (the limit is %d bytes).", word, maxWordLen)
+	if cfg.json || cfg.quiet || cfg.dryRun || isTerminal(os.Stderr) {
+		fmt.Fprintln(os.Stderr, "define:", msg)
 		return
 	}
+	notifyDBusAndHandleClick(cfg, p, "", diskEntry{
+		Title:  "📘 Word too long",
+		Body:   markupEscaper.Replace(msg),
+		Full:   msg,
+		TS:     time.Now(),
+		Source: "none",
+	})
+}
+
+// exitCode maps a lookup's source to the process exit code.
+func exitCode(source string) int {
+	switch source {
+	case "none":
+		return exitNotFound
+	case "unreachable":
+		return exitUnavailable
+	}
+	return 0
+}
+
+// printVersion prints the build version, the Go version and, when the
+// binary was built from a checkout, the VCS revision.
+func printVersion() {
+	line := fmt.Sprintf("define %s (%s)", version, runtime.Version())
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		var rev, dirty string
+		for _, st := range bi.Settings {
+			switch st.Key {
+			case "vcs.revision":
+				rev = st.Value
+			case "vcs.modified":
+				if st.Value == "true" {
+					dirty = "-dirty"
+				}
+			}
+		}
+		if rev != "" {
+			line += fmt.Sprintf(" rev %.12s%s", rev, dirty)
+		}
+	}
+	fmt.Println(line)
+}
+
+// usage is printed by --help and after a bad command line.
+const usage = `Usage: define [flags] [word]
+
+Defines word, or the current selection when no word is given.
+
+Lookup:
+  --phrase            look up the whole first line, not just the first word
+  --word-index=N      define the N-th word (0-based) instead of the first
+  --clipboard         read what was copied (Ctrl+C) before the selection
+  --random            define a random word
+  --means             list words that mean the description given
+  --lang=CODE         language to look up (en, es, fr, de, ja, ...)
+  --pos=POS           only show one part of speech (noun, verb, ...)
+  --force-online      skip the cache and the offline source
+  --no-offline        never fall back to the offline dict
+  --offline-only      use only the offline dict; nothing goes online
+  --race              query the online sources at the same time
+  --stem              also try the word's Porter stem
+  --any-lang          let Wiktionary answer from another language's section
+  --sequential        try word forms one at a time (less traffic, slower)
+  --all-sources       ask every source; the full view lists each answer
+  --no-thesaurus      skip synonyms and antonyms
+  --no-etymology      skip the etymology in the full view
+
+Output:
+  --json              print the result as JSON instead of notifying
+  --quiet             no output; only the exit code
+  --dry-run           show the cache key, candidates and sources; fetch nothing
+  --expire=DURATION   close the notification after DURATION (e.g. 8s)
+  --sound             play a sound with the notification
+  --no-markup         plain-text notification body, for servers without markup
+  --full              open the last full definition
+  --last              show the last notification again
+  --history[=N]       list the last N lookups (default 20)
+  --misses            list words no source could define
+  --export=FORMAT     write the cache as anki (tab-separated) or csv to stdout
+  --export-from=FROM  export cache (default) or bookmarks
+  --export-source=S   with --export: only entries from sources S (comma list)
+  --since=DURATION    with --export: only entries newer than DURATION
+  --repl              define each word typed on stdin until EOF or :q
+  --save              bookmark the word as well as showing it
+  --bookmarks         list the saved words
+  --search TEXT       list cached words whose definition contains TEXT
+  --review            show the saved word reviewed longest ago
+
+Daemon and cache:
+  --daemon            run the background daemon
+  --watch             with --daemon: define each new selection
+  --metrics-addr=ADDR with --daemon: serve metrics on 127.0.0.1, e.g. :9187
+  --no-daemon         resolve in this process even if a daemon is running
+  --autospawn         start a daemon when none is running, then use it
+  --stop              stop the daemon
+  --status            show daemon and cache status
+  --clear-cache       remove the cache (with --expired-only: just expired entries)
+
+  --debug             log timing and source decisions to stderr
+  --version           print the version
+  --help              show this help
+`
 
-	_ = clientSend(cfg, word)
+// conflictingFlags are pairs that make no sense on one command line.
+var conflictingFlags = [][2]string{
+	{"--offline-only", "--force-online"},
+	{"--offline-only", "--no-offline"},
+	{"--force-online", "--no-offline"}, // --force-online already skips offline
+	{"--json", "--quiet"},
+	{"--autospawn", "--no-daemon"},
 }
 
-func parseArgs(args []string) config {
-	cfg := config{}
+// parseArgs applies command-line flags on top of cfg (the config file
+// defaults). Unknown flags and conflicting combinations are errors; bad
+// values for a known flag are reported and ignored.
+func parseArgs(cfg config, args []string) (config, error) {
+	seen := map[string]bool{}
 	for _, a := range args {
+		if strings.HasPrefix(a, "--") {
+			name, _, _ := strings.Cut(a, "=")
+			seen[name] = true
+		}
+		if v, ok := strings.CutPrefix(a, "--history="); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				fmt.Fprintf(os.Stderr, "define: invalid --history %q, using %d\n", v, historyDefault)
+				n = historyDefault
+			}
+			cfg.history = n
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--expire="); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				fmt.Fprintf(os.Stderr, "define: invalid --expire %q, want a duration like 8s\n", v)
+				continue
+			}
+			cfg.expire = d
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--metrics-addr="); ok {
+			addr, err := metricsListenAddr(v)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "define: invalid --metrics-addr %q (%v), metrics are off\n", v, err)
+				continue
+			}
+			cfg.metricsAddr = addr
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--word-index="); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "define: invalid --word-index %q, using the first word\n", v)
+				continue
+			}
+			cfg.wordIndex = n
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--pos="); ok {
+			v = strings.ToLower(strings.TrimSpace(v))
+			if !partsOfSpeech[v] {
+				fmt.Fprintf(os.Stderr, "define: unknown --pos %q, showing all parts of speech\n", v)
+				continue
+			}
+			cfg.pos = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--export="); ok {
+			if v != "anki" && v != "csv" {
+				return cfg, fmt.Errorf("--export: want anki or csv, not %q", v)
+			}
+			cfg.export = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--export-from="); ok {
+			if v != "cache" && v != "bookmarks" {
+				return cfg, fmt.Errorf("--export-from: want cache or bookmarks, not %q", v)
+			}
+			cfg.exportFrom = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--export-source="); ok {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					cfg.exportSrcs = append(cfg.exportSrcs, name)
+				}
+			}
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--since="); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("--since: want a duration like 168h, not %q", v)
+			}
+			cfg.since = d
+			continue
+		}
+		if v, ok := strings.CutPrefix(a, "--lang="); ok {
+			v = strings.ToLower(strings.TrimSpace(v))
+			if !supportedLangs[v] {
+				fmt.Fprintf(os.Stderr, "define: unsupported --lang %q, using %s\n", v, cfg.lang)
+				continue
+			}
+			cfg.lang = v
+			continue
+		}
 		switch a {
 		case "--debug":
 			cfg.debug = true
+		case "--version":
+			cfg.version = true
 		case "--daemon":
 			cfg.daemon = true
+		case "--watch":
+			cfg.watch = true
+		case "--no-daemon":
+			cfg.noDaemon = true
 		case "--force-online":
 			cfg.forceOnline = true
 		case "--no-offline":
 			cfg.noOffline = true
+		case "--offline-only":
+			cfg.offlineOnly = true
 		case "--full":
 			cfg.fullView = true
+		case "--last":
+			cfg.last = true
+		case "--stop":
+			cfg.stop = true
+		case "--clear-cache":
+			cfg.clearCache = true
+		case "--expired-only":
+			cfg.expiredOnly = true
+		case "--json":
+			cfg.json = true
+		case "--quiet":
+			cfg.quiet = true
+		case "--dry-run":
+			cfg.dryRun = true
+		case "--phrase":
+			cfg.phrase = true
+		case "--random":
+			cfg.random = true
+		case "--no-thesaurus":
+			cfg.noThesaurus = true
+		case "--no-etymology":
+			cfg.noEtymology = true
+		case "--race":
+			cfg.race = true
+		case "--stem":
+			cfg.stem = true
+		case "--any-lang":
+			cfg.anyLang = true
+		case "--sequential":
+			cfg.sequential = true
+		case "--means":
+			cfg.means = true
+		case "--autospawn":
+			cfg.autospawn = true
+		case "--no-markup":
+			cfg.noMarkup = true
+		case "--clipboard":
+			cfg.clipboard = true
+		case "--sound":
+			cfg.sound = true
+		case "--all-sources":
+			cfg.allSources = true
+		case "--status":
+			cfg.status = true
+		case "--history":
+			cfg.history = historyDefault
+		case "--misses":
+			cfg.misses = true
+		case "--repl":
+			cfg.repl = true
+		case "--save":
+			cfg.save = true
+		case "--bookmarks":
+			cfg.bookmarks = true
+		case "--search":
+			cfg.search = true
+		case "--review":
+			cfg.review = true
+		case "--help", "-h":
+			cfg.help = true
+		default:
+			if strings.HasPrefix(a, "--") {
+				return cfg, fmt.Errorf("unknown flag %q", a)
+			}
+		}
+	}
+	for _, c := range conflictingFlags {
+		if seen[c[0]] && seen[c[1]] {
+			return cfg, fmt.Errorf("%s and %s can't be used together", c[0], c[1])
+		}
+	}
+	if seen["--expired-only"] && !seen["--clear-cache"] {
+		return cfg, errors.New("--expired-only needs --clear-cache")
+	}
+	// A flag beats a contrary default from the config file.
+	if seen["--offline-only"] {
+		cfg.forceOnline = false
+	}
+	if seen["--force-online"] {
+		cfg.noOffline = false
+	}
+	return cfg, nil
+}
+
+func configDir() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "define")
+}
+
+func configFilePath() string { return filepath.Join(configDir(), "config.toml") }
+func customFilePath() string { return filepath.Join(configDir(), "custom.json") }
+
+// loadConfig reads the defaults from config.toml. A missing file is not an
+// error; bad lines are reported on stderr and skipped.
+//
+// Only the small subset of TOML the schema needs is understood:
+//
+//	force_online = true
+//	no_offline = false
+//	lang = "es"
+//	sources = ["custom", "online", "wiktionary", "offline"]
+//	expire = "8s"
+//	race = true
+//	examples = 3
+//	stem = true
+//	any_lang = true
+//	sequential = true
+//	sound = true
+//	sound_found = "message-new-instant"
+//	sound_none = "dialog-error"
+//	title_format = "{word} ({source})"
+//	dnd = "queue"
+//	autospawn = true
+//	no_markup = true
+func loadConfig() config {
+	cfg := config{
+		lang:        defaultLang,
+		maxMeanings: envLimit("DEFINE_MAX_MEANINGS", meaningsDefault),
+		maxDefs:     envLimit("DEFINE_MAX_DEFS", defsDefault),
+		maxExamples: examplesDefault,
+		soundFound:  "message-new-instant",
+		soundNone:   "dialog-error",
+		bodyMax:     envBodyMax(),
+		titleFormat: cmp.Or(os.Getenv("DEFINE_TITLE_FORMAT"), titleFormatDefault),
+	}
+	path := configFilePath()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg
+	}
+	for i, ln := range strings.Split(string(b), "\n") {
+		if err := applyConfigLine(&cfg, ln); err != nil {
+			fmt.Fprintf(os.Stderr, "define: %s:%d: %v\n", path, i+1, err)
 		}
 	}
 	return cfg
 }
 
+func applyConfigLine(cfg *config, ln string) error {
+	ln = strings.TrimSpace(ln)
+	if ln == "" || strings.HasPrefix(ln, "#") || strings.HasPrefix(ln, "[") {
+		return nil
+	}
+	k, v, ok := strings.Cut(ln, "=")
+	if !ok {
+		return errors.New("expected key = value")
+	}
+	k = strings.TrimSpace(k)
+	v = strings.TrimSpace(v)
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+
+	switch k {
+	case "force_online", "no_offline", "race", "stem", "sound", "any_lang", "sequential", "autospawn", "no_markup":
+		bv, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: want true or false", k)
+		}
+		switch k {
+		case "force_online":
+			cfg.forceOnline = bv
+		case "no_offline":
+			cfg.noOffline = bv
+		case "race":
+			cfg.race = bv
+		case "stem":
+			cfg.stem = bv
+		case "any_lang":
+			cfg.anyLang = bv
+		case "sequential":
+			cfg.sequential = bv
+		case "autospawn":
+			cfg.autospawn = bv
+		case "no_markup":
+			cfg.noMarkup = bv
+		case "sound":
+			cfg.sound = bv
+		}
+	case "lang":
+		l := strings.ToLower(unquote(v))
+		if !supportedLangs[l] {
+			return fmt.Errorf("unsupported lang %q", l)
+		}
+		cfg.lang = l
+	case "sources":
+		if !strings.HasPrefix(v, "[") || !strings.HasSuffix(v, "]") {
+			return errors.New("sources: want a list like [\"online\", \"offline\"]")
+		}
+		var srcs []string
+		for _, item := range strings.Split(strings.Trim(v, "[]"), ",") {
+			name := strings.ToLower(unquote(strings.TrimSpace(item)))
+			if name == "" {
+				continue
+			}
+			if sourceRegistry[name] == nil {
+				return fmt.Errorf("unknown source %q", name)
+			}
+			srcs = append(srcs, name)
+		}
+		cfg.sources = srcs
+	case "expire":
+		d, err := time.ParseDuration(unquote(v))
+		if err != nil || d < 0 {
+			return fmt.Errorf("expire: want a duration like \"8s\"")
+		}
+		cfg.expire = d
+	case "dnd":
+		mode := unquote(v)
+		if mode != "show" && mode != "suppress" && mode != "queue" {
+			return fmt.Errorf("dnd: want \"show\", \"suppress\" or \"queue\"")
+		}
+		cfg.dnd = mode
+	case "title_format":
+		f := unquote(v)
+		if strings.TrimSpace(f) == "" {
+			return fmt.Errorf("title_format: want a format like %q", titleFormatDefault)
+		}
+		cfg.titleFormat = f
+	case "sound_found", "sound_none":
+		name := unquote(v)
+		if name == "" {
+			return fmt.Errorf("%s: want a sound name like \"message-new-instant\"", k)
+		}
+		if k == "sound_found" {
+			cfg.soundFound = name
+		} else {
+			cfg.soundNone = name
+		}
+	case "examples":
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > limitMax {
+			return fmt.Errorf("examples: want a number from 0 to %d", limitMax)
+		}
+		if n == 0 {
+			n = noExamples
+		}
+		cfg.maxExamples = n
+	default:
+		return fmt.Errorf("unknown key %q", k)
+	}
+	return nil
+}
+
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
 func filterOutFlags(args []string) []string {
 	out := make([]string, 0, len(args))
 	for _, a := range args {
@@ -136,6 +925,14 @@ func filterOutFlags(args []string) []string {
 	return out
 }
 
+// debugf logs a timestamped line to stderr when --debug is set.
+func debugf(cfg config, format string, args ...any) {
+	if !cfg.debug {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s define: %s\n", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, args...))
+}
+
 func ensureCommonPATH() {
 	p := os.Getenv("PATH")
 	need := []string{"/usr/local/bin", "/usr/bin", "/bin"}
@@ -154,19 +951,104 @@ func resolvePaths() paths {
 	}
 	return paths{
 		wlPaste: look("wl-paste"),
+		wlCopy:  look("wl-copy"),
+		xclip:   look("xclip"),
+		xsel:    look("xsel"),
 		dict:    look("dict"),
 		zenity:  look("zenity"),
+		kdialog: look("kdialog"),
+		yad:     look("yad"),
+		xterm:   look("xterm"),
+		player:  lookFirst(look, "mpv", "ffplay", "pw-play", "paplay"),
+		xdgOpen: look("xdg-open"),
+
+		dunstctl:  look("dunstctl"),
+		makoctl:   look("makoctl"),
+		swaync:    look("swaync-client"),
+		gsettings: look("gsettings"),
+	}
+}
+
+func lookFirst(look func(string) string, bins ...string) string {
+	for _, b := range bins {
+		if p := look(b); p != "" {
+			return p
+		}
 	}
+	return ""
 }
 
 func runtimeSocketPath() string {
 	dir := os.Getenv("XDG_RUNTIME_DIR")
 	if dir == "" {
-		dir = "/tmp"
+		return fallbackSocketPath()
+	}
+	return socketPathIn(dir)
+}
+
+// fallbackSocketPath is where the daemon listens without a usable runtime
+// dir (unset, full, read-only, missing).
+func fallbackSocketPath() string { return socketPathIn(os.TempDir()) }
+
+// socketPathIn names the socket in dir. XDG_RUNTIME_DIR is per user, but
+// /tmp is shared, so there the name carries the UID ("define-1000.sock").
+func socketPathIn(dir string) string {
+	dir = filepath.Clean(dir)
+	if dir == "/tmp" || dir == filepath.Clean(os.TempDir()) {
+		return filepath.Join(dir, fmt.Sprintf("define-%d.sock", os.Getuid()))
 	}
 	return filepath.Join(dir, socketName)
 }
 
+// daemonSocketPath is the socket clients should use: the runtime one, or
+// the fallback when only that exists.
+func daemonSocketPath() string {
+	sock := runtimeSocketPath()
+	if _, err := os.Stat(sock); err != nil {
+		if _, err := os.Stat(fallbackSocketPath()); err == nil {
+			return fallbackSocketPath()
+		}
+	}
+	return sock
+}
+
+// errDaemonRunning means another daemon already answers on the socket.
+var errDaemonRunning = errors.New("a daemon is already running")
+
+// listenSocket listens on the runtime socket, falling back to
+// fallbackSocketPath when that fails.
+func listenSocket() (net.Listener, string, error) {
+	sock := runtimeSocketPath()
+	ln, err := listenUnix(sock)
+	if err == nil || errors.Is(err, errDaemonRunning) {
+		return ln, sock, err
+	}
+	fb := fallbackSocketPath()
+	if fb == sock {
+		return nil, "", err
+	}
+	fmt.Fprintf(os.Stderr, "define: can't listen on %s (%v), using %s\n", sock, err, fb)
+	ln, err = listenUnix(fb)
+	return ln, fb, err
+}
+
+// listenUnix listens on sock. A socket file already there is taken over
+// only if nothing answers on it, so of two daemons started at once (say,
+// by two --autospawn clients) the second gets errDaemonRunning instead of
+// stealing the first one's socket.
+func listenUnix(sock string) (net.Listener, error) {
+	ln, err := net.Listen("unix", sock)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return ln, err
+	}
+	if conn, derr := net.DialTimeout("unix", sock, 200*time.Millisecond); derr == nil {
+		_ = conn.Close()
+		return nil, errDaemonRunning
+	}
+	_ = os.Remove(sock) // left behind by a daemon that died
+	return net.Listen("unix", sock)
+}
+
 func cacheDir() string {
 	dir := os.Getenv("XDG_CACHE_HOME")
 	if dir == "" {
@@ -180,6 +1062,13 @@ func cacheDir() string {
 
 func cacheFilePath() string { return filepath.Join(cacheDir(), "cache.json") }
 func lastFilePath() string  { return filepath.Join(cacheDir(), "last.txt") }
+func historyFilePath() string {
+	return filepath.Join(cacheDir(), "history.jsonl")
+}
+func missesFilePath() string { return filepath.Join(cacheDir(), "misses.txt") }
+func bookmarksFilePath() string {
+	return filepath.Join(cacheDir(), "bookmarks.jsonl")
+}
 
 func runCmdCapture(name string, args ...string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
@@ -191,70 +1080,552 @@ func runCmdCapture(name string, args ...string) (string, error) {
 	return strings.TrimSpace(outb.String()), err
 }
 
-func getSelectedTextWayland(cfg config, p paths) string {
-	if p.wlPaste == "" {
-		return ""
+// sessionType reports "wayland", "x11", or "" when it can't tell.
+func sessionType() string {
+	switch strings.ToLower(os.Getenv("XDG_SESSION_TYPE")) {
+	case "wayland":
+		return "wayland"
+	case "x11":
+		return "x11"
 	}
-	if out, _ := runCmdCapture(p.wlPaste, "-p", "--no-newline"); out != "" {
-		return out
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return "wayland"
 	}
-	if out, _ := runCmdCapture(p.wlPaste, "--no-newline"); out != "" {
-		return out
+	if os.Getenv("DISPLAY") != "" {
+		return "x11"
 	}
 	return ""
 }
 
-func pickWord(s string) string {
-	s = strings.TrimSpace(s)
+// selectionCommands returns the commands to try, in order, to read the
+// selection: PRIMARY first, then the regular clipboard, or the other way
+// round with clipboard (--clipboard). An unknown session tries the Wayland
+// tools and then the X11 ones.
+func selectionCommands(session string, p paths, clipboard bool) [][]string {
+	var wl, x11 [][]string
+	both := func(primary, regular []string) [][]string {
+		if clipboard {
+			return [][]string{regular, primary}
+		}
+		return [][]string{primary, regular}
+	}
+	if p.wlPaste != "" {
+		wl = append(wl, both(
+			[]string{p.wlPaste, "-p", "--no-newline"},
+			[]string{p.wlPaste, "--no-newline"},
+		)...)
+	}
+	if p.xclip != "" {
+		x11 = append(x11, both(
+			[]string{p.xclip, "-o", "-selection", "primary"},
+			[]string{p.xclip, "-o", "-selection", "clipboard"},
+		)...)
+	}
+	if p.xsel != "" {
+		x11 = append(x11, both(
+			[]string{p.xsel, "-o", "-p"},
+			[]string{p.xsel, "-o", "-b"},
+		)...)
+	}
+	switch session {
+	case "wayland":
+		return wl
+	case "x11":
+		return x11
+	}
+	return append(wl, x11...)
+}
+
+// copyCommand returns the command that writes its stdin to the regular
+// clipboard, or nil when there is no tool for the session.
+func copyCommand(session string, p paths) []string {
+	switch {
+	case p.wlCopy != "" && session != "x11":
+		return []string{p.wlCopy}
+	case session == "wayland":
+		return nil
+	case p.xclip != "":
+		return []string{p.xclip, "-selection", "clipboard", "-in"}
+	case p.xsel != "":
+		return []string{p.xsel, "-b", "-i"}
+	}
+	return nil
+}
+
+func copyToClipboard(p paths, text string) {
+	c := copyCommand(sessionType(), p)
+	if c == nil {
+		return
+	}
+	cmd := exec.Command(c[0], c[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	_ = cmd.Run()
+}
+
+func getSelectedText(cfg config, p paths) string {
+	for _, c := range selectionCommands(sessionType(), p, cfg.clipboard) {
+		if out, _ := runCmdCapture(c[0], c[1:]...); out != "" {
+			return out
+		}
+	}
+	return ""
+}
+
+func pickWord(s string) string { return pickNthWord(s, 0) }
+
+// pickNthWord is the n-th (0-based) word of the selection's first line, with
+// surrounding punctuation trimmed. An n past the last word picks the first.
+func pickNthWord(s string, n int) string {
+	s = strings.TrimSpace(joinLineHyphens(s))
 	if s == "" {
 		return ""
 	}
 	if i := strings.IndexByte(s, '\n'); i >= 0 {
 		s = s[:i]
 	}
-	s = strings.Trim(s, " \t\r\n\"“”‘’.,;:!?()[]{}")
-	if s == "" {
-		return ""
+	var parts []string
+	for _, f := range strings.Fields(s) {
+		if f = strings.Trim(f, selectionTrim); f != "" {
+			parts = append(parts, f)
+		}
 	}
-	parts := strings.Fields(s)
 	if len(parts) == 0 {
 		return ""
 	}
-	return parts[0]
+	if n < 0 || n >= len(parts) {
+		n = 0
+	}
+	return normalizeWord(parts[n])
+}
+
+// joinLineHyphens rejoins words hyphenated across a line break, so the
+// first line of "estab-\nlishment" is "establishment". A hyphen that
+// really belongs to a compound split at its hyphen is lost too, but that is
+// rarer than justified text, and the rest of the compound still looks up.
+func joinLineHyphens(s string) string {
+	return lineHyphenRe.ReplaceAllString(s, "$1$2")
+}
+
+// apostropheFolder maps typographic apostrophes to the straight one wordRe
+// accepts ("don’t" → "don't").
+var apostropheFolder = strings.NewReplacer("’", "'", "‘", "'", "ʼ", "'")
+
+// normalizeWord NFC-composes w, so text copied from PDFs with combining
+// accents ("cafe\u0301") matches the APIs and cache keys, and folds
+// typographic apostrophes.
+func normalizeWord(w string) string {
+	return apostropheFolder.Replace(norm.NFC.String(w))
 }
 
 func validWord(w string) bool {
 	return w != "" && len(w) <= maxWordLen && wordRe.MatchString(w)
 }
 
-func lemmaCandidates(w string) []string {
-	w = strings.ToLower(w)
-	cands := []string{w}
-	if strings.HasSuffix(w, "ies") && len(w) > 4 {
-		cands = append(cands, w[:len(w)-3]+"y")
+// pickPhrase is pickWord for --phrase: it keeps the whole first line, with
+// whitespace collapsed to single spaces, instead of only its first token.
+func pickPhrase(s string) string {
+	s = strings.TrimSpace(joinLineHyphens(s))
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.Trim(s, selectionTrim)
+	return normalizeWord(strings.Join(strings.Fields(s), " "))
+}
+
+func validPhrase(w string) bool {
+	return w != "" && len(w) <= maxWordLen && phraseRe.MatchString(w)
+}
+
+// embeddedWords is a few thousand common English words for --random.
+//
+//go:embed words.txt
+var embeddedWords string
+
+// randomWord picks a word from the embedded list, preferring ones that
+// aren't in the disk cache yet so repeated use keeps showing new words.
+func randomWord(disk map[string]diskEntry) string {
+	words := strings.Fields(embeddedWords)
+	fresh := make([]string, 0, len(words))
+	for _, w := range words {
+		if _, seen := disk[w]; !seen {
+			fresh = append(fresh, w)
+		}
+	}
+	if len(fresh) > 0 {
+		words = fresh
+	}
+	return words[rand.IntN(len(words))]
+}
+
+// contractions maps negative contractions whose base verb the generic
+// "n't" rule would get wrong ("won't" → "wo").
+var contractions = map[string]string{
+	"won't": "will", "can't": "can", "shan't": "shall", "ain't": "be",
+	"isn't": "be", "aren't": "be", "wasn't": "be", "weren't": "be",
+	"doesn't": "do", "didn't": "do", "hasn't": "have", "hadn't": "have",
+}
+
+// irregularForms maps common irregular plurals, verb forms and comparatives
+// to their base form, for the cases the suffix rules can't reach.
+var irregularForms = map[string]string{
+	// nouns
+	"mice": "mouse", "lice": "louse", "feet": "foot", "teeth": "tooth",
+	"geese": "goose", "children": "child", "men": "man", "women": "woman",
+	"people": "person", "oxen": "ox", "dice": "die", "knives": "knife",
+	"wives": "wife", "lives": "life", "leaves": "leaf", "halves": "half",
+	"wolves": "wolf", "shelves": "shelf", "thieves": "thief", "loaves": "loaf",
+	"criteria": "criterion", "phenomena": "phenomenon", "cacti": "cactus",
+	"fungi": "fungus", "nuclei": "nucleus", "analyses": "analysis",
+	"crises": "crisis", "theses": "thesis", "indices": "index",
+	"appendices": "appendix", "matrices": "matrix", "media": "medium",
+
+	// verbs
+	"am": "be", "is": "be", "are": "be", "was": "be", "were": "be",
+	"been": "be", "being": "be", "did": "do", "does": "do", "done": "do",
+	"had": "have", "has": "have", "went": "go", "gone": "go", "ran": "run",
+	"saw": "see", "seen": "see", "came": "come", "took": "take",
+	"taken": "take", "gave": "give", "given": "give", "ate": "eat",
+	"eaten": "eat", "wrote": "write", "written": "write", "spoke": "speak",
+	"spoken": "speak", "broke": "break", "broken": "break", "chose": "choose",
+	"chosen": "choose", "drove": "drive", "driven": "drive", "flew": "fly",
+	"flown": "fly", "knew": "know", "known": "know", "grew": "grow",
+	"grown": "grow", "threw": "throw", "thrown": "throw", "began": "begin",
+	"begun": "begin", "sang": "sing", "sung": "sing", "swam": "swim",
+	"swum": "swim", "drank": "drink", "drunk": "drink", "rode": "ride",
+	"ridden": "ride", "rose": "rise", "risen": "rise", "fell": "fall",
+	"fallen": "fall", "felt": "feel", "kept": "keep", "left": "leave",
+	"lost": "lose", "meant": "mean", "met": "meet", "paid": "pay",
+	"said": "say", "sold": "sell", "sent": "send", "slept": "sleep",
+	"spent": "spend", "stood": "stand", "taught": "teach", "thought": "think",
+	"told": "tell", "understood": "understand", "won": "win", "wore": "wear",
+	"worn": "wear", "bought": "buy", "brought": "bring", "caught": "catch",
+	"fought": "fight", "sought": "seek", "built": "build", "dug": "dig",
+	"found": "find", "held": "hold", "led": "lead", "made": "make",
+	"heard": "hear", "hid": "hide", "hidden": "hide", "shook": "shake",
+	"shaken": "shake", "stole": "steal", "stolen": "steal", "froze": "freeze",
+	"frozen": "freeze", "woke": "wake", "woken": "wake", "forgot": "forget",
+	"forgotten": "forget", "forgave": "forgive", "forgiven": "forgive",
+	"got": "get", "gotten": "get", "lain": "lie", "struck": "strike",
+	"swore": "swear", "sworn": "swear", "tore": "tear", "torn": "tear",
+	"wept": "weep", "fed": "feed", "fled": "flee", "sat": "sit",
+	"spun": "spin", "stuck": "stick", "stung": "sting", "swept": "sweep",
+	"bent": "bend", "bled": "bleed", "bred": "breed", "dealt": "deal",
+	"drew": "draw", "drawn": "draw", "dreamt": "dream", "knelt": "kneel",
+	"leapt": "leap", "lent": "lend", "sank": "sink", "sunk": "sink",
+	"shone": "shine", "shot": "shoot", "slid": "slide", "sprang": "spring",
+	"sprung": "spring", "strove": "strive", "swung": "swing", "wound": "wind",
+
+	// comparatives and superlatives
+	"better": "good", "best": "good", "worse": "bad", "worst": "bad",
+	"more": "many", "most": "many", "less": "little", "least": "little",
+	"further": "far", "furthest": "far", "farther": "far", "farthest": "far",
+	"elder": "old", "eldest": "old",
+}
+
+// stemVariants undoes the spelling changes made when a suffix was added: a
+// doubled final consonant ("stopp" → "stop") or a dropped "e" ("mak" → "make").
+func stemVariants(stem string) []string {
+	n := len(stem)
+	if n >= 3 && stem[n-1] == stem[n-2] {
+		if strings.IndexByte("aeioulsfz", stem[n-1]) >= 0 {
+			return []string{stem} // "call", "pass", "stuff", "buzz", "free"
+		}
+		return []string{stem[:n-1], stem}
+	}
+	if n >= 2 && isConsonant(stem[n-1]) && strings.IndexByte("wxy", stem[n-1]) < 0 && !isConsonant(stem[n-2]) {
+		return []string{stem, stem + "e"}
+	}
+	return []string{stem}
+}
+
+func isConsonant(c byte) bool {
+	return c >= 'a' && c <= 'z' && strings.IndexByte("aeiou", c) < 0
+}
+
+// lemma is a lookup candidate for a word and the inflection that was undone
+// to get it ("present participle"); the word itself has no rule.
+type lemma struct {
+	word, rule string
+}
+
+func lemmaCandidates(w string) []lemma {
+	w = strings.ToLower(w)
+	cands := []lemma{{w, ""}}
+	add := func(rule string, words ...string) {
+		for _, c := range words {
+			cands = append(cands, lemma{c, rule})
+		}
+	}
+	// "dog's" and "dogs'" go on to the rules below through their base, so
+	// "dogs'" still reaches "dog".
+	if base, ok := possessiveBase(w); ok {
+		for _, c := range lemmaCandidates(base) {
+			if c.rule == "" {
+				c.rule = "possessive"
+			}
+			cands = append(cands, c)
+		}
+		return dedupeLemmas(cands)
+	}
+	if base, ok := contractions[w]; ok {
+		add("negative contraction", base)
+	} else if base, ok := strings.CutSuffix(w, "n't"); ok && len(base) > 1 {
+		add("negative contraction", base) // "don't", "shouldn't", "needn't"
+	}
+	if base, ok := irregularForms[w]; ok {
+		add("inflected form", base)
+	}
+	if strings.HasSuffix(w, "ies") && len(w) > 4 {
+		add("plural", w[:len(w)-3]+"y")
 	}
 	if strings.HasSuffix(w, "es") && len(w) > 4 {
-		cands = append(cands, w[:len(w)-2])
+		add("plural", w[:len(w)-2])
 	}
 	if strings.HasSuffix(w, "s") && len(w) > 3 && !strings.HasSuffix(w, "ss") {
-		cands = append(cands, strings.TrimSuffix(w, "s"))
+		add("plural", strings.TrimSuffix(w, "s"))
+	}
+	if strings.HasSuffix(w, "ing") && len(w) > 5 {
+		add("present participle", stemVariants(w[:len(w)-3])...)
+	}
+	if strings.HasSuffix(w, "ied") && len(w) > 4 {
+		add("past tense", w[:len(w)-3]+"y")
+	} else if strings.HasSuffix(w, "ed") && len(w) > 4 {
+		add("past tense", stemVariants(w[:len(w)-2])...)
+	}
+	if strings.HasSuffix(w, "iest") && len(w) > 5 {
+		add("superlative", w[:len(w)-4]+"y")
+	} else if strings.HasSuffix(w, "est") && len(w) > 5 {
+		add("superlative", stemVariants(w[:len(w)-3])...)
+	}
+	if strings.HasSuffix(w, "ier") && len(w) > 4 {
+		add("comparative", w[:len(w)-3]+"y")
+	} else if strings.HasSuffix(w, "er") && len(w) > 4 {
+		add("comparative", stemVariants(w[:len(w)-2])...)
+	}
+	return dedupeLemmas(cands)
+}
+
+// porterStem is M. F. Porter's 1980 suffix-stripping algorithm. Words with
+// anything but a-z, or of two letters or fewer, are returned unchanged.
+func porterStem(w string) string {
+	if len(w) <= 2 || strings.IndexFunc(w, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0 {
+		return w
+	}
+
+	// Step 1a: plurals.
+	switch {
+	case strings.HasSuffix(w, "sses"), strings.HasSuffix(w, "ies"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+
+	// Step 1b: -ed and -ing.
+	if stem, ok := strings.CutSuffix(w, "eed"); ok {
+		if porterMeasure(stem) > 0 {
+			w = w[:len(w)-1]
+		}
+	} else if stem, ok := cutEither(w, "ed", "ing"); ok && porterHasVowel(stem) {
+		w = stem
+		switch {
+		case strings.HasSuffix(w, "at"), strings.HasSuffix(w, "bl"), strings.HasSuffix(w, "iz"):
+			w += "e"
+		case porterDouble(w) && strings.IndexByte("lsz", w[len(w)-1]) < 0:
+			w = w[:len(w)-1]
+		case porterMeasure(w) == 1 && porterCVC(w):
+			w += "e"
+		}
+	}
+
+	// Step 1c: y → i.
+	if stem, ok := strings.CutSuffix(w, "y"); ok && porterHasVowel(stem) {
+		w = stem + "i"
+	}
+
+	w = porterReplace(w, step2Suffixes)
+	w = porterReplace(w, step3Suffixes)
+
+	// Step 4: drop a suffix from a long enough stem; -ion only after s or t.
+	for _, suf := range step4Suffixes {
+		stem, ok := strings.CutSuffix(w, suf)
+		if !ok || (suf == "ion" && !strings.HasSuffix(stem, "s") && !strings.HasSuffix(stem, "t")) {
+			continue
+		}
+		if porterMeasure(stem) > 1 {
+			w = stem
+		}
+		break
+	}
+
+	// Step 5: a final -e, and -ll.
+	if stem, ok := strings.CutSuffix(w, "e"); ok {
+		if m := porterMeasure(stem); m > 1 || (m == 1 && !porterCVC(stem)) {
+			w = stem
+		}
+	}
+	if porterMeasure(w) > 1 && porterDouble(w) && strings.HasSuffix(w, "l") {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// step2Suffixes and step3Suffixes map a suffix to its replacement. Only the
+// first that matches counts, even when its stem is too short to change.
+var (
+	step2Suffixes = [][2]string{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+		{"izer", "ize"}, {"abli", "able"}, {"alli", "al"}, {"entli", "ent"},
+		{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+		{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+		{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	}
+	step3Suffixes = [][2]string{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+		{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+	}
+	step4Suffixes = []string{
+		"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement",
+		"ment", "ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+	}
+)
+
+// porterReplace applies the first matching rule if its stem has a measure
+// above zero.
+func porterReplace(w string, rules [][2]string) string {
+	for _, rule := range rules {
+		if stem, ok := strings.CutSuffix(w, rule[0]); ok {
+			if porterMeasure(stem) > 0 {
+				return stem + rule[1]
+			}
+			return w
+		}
+	}
+	return w
+}
+
+func cutEither(w string, suffixes ...string) (string, bool) {
+	for _, suf := range suffixes {
+		if stem, ok := strings.CutSuffix(w, suf); ok {
+			return stem, true
+		}
+	}
+	return w, false
+}
+
+// porterCons reports whether w[i] is a consonant; y is one only after a vowel
+// or at the start.
+func porterCons(w string, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !porterCons(w, i-1)
+	}
+	return true
+}
+
+// porterMeasure is m in [C](VC)^m[V]: the number of vowel-consonant runs.
+func porterMeasure(w string) int {
+	m := 0
+	prevVowel := false
+	for i := range len(w) {
+		c := porterCons(w, i)
+		if c && prevVowel {
+			m++
+		}
+		prevVowel = !c
+	}
+	return m
+}
+
+func porterHasVowel(w string) bool {
+	for i := range len(w) {
+		if !porterCons(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// porterDouble reports a doubled final consonant ("hopp").
+func porterDouble(w string) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && porterCons(w, n-1)
+}
+
+// porterCVC reports a consonant-vowel-consonant ending whose last letter is
+// not w, x or y ("hop", but not "snow").
+func porterCVC(w string) bool {
+	n := len(w)
+	return n >= 3 && porterCons(w, n-3) && !porterCons(w, n-2) && porterCons(w, n-1) &&
+		strings.IndexByte("wxy", w[n-1]) < 0
+}
+
+// possessiveBase strips a possessive "'s" or a plural's trailing apostrophe.
+func possessiveBase(w string) (string, bool) {
+	if base, ok := strings.CutSuffix(w, "'s"); ok && base != "" {
+		return base, true
+	}
+	if base, ok := strings.CutSuffix(w, "s'"); ok && base != "" {
+		return base + "s", true
 	}
+	return "", false
+}
+
+func dedupeLemmas(cands []lemma) []lemma {
 	seen := map[string]bool{}
-	out := make([]string, 0, len(cands))
+	out := make([]lemma, 0, len(cands))
 	for _, c := range cands {
-		if !seen[c] {
-			seen[c] = true
+		if !seen[c.word] {
+			seen[c.word] = true
 			out = append(out, c)
 		}
 	}
 	return out
 }
 
+// lookupCandidates is what the sources are asked for: the lemma candidates
+// and, with --stem, the Porter stem last, since it is not always a word.
+func lookupCandidates(cfg config, word string) []lemma {
+	cands := lemmaCandidates(word)
+	if cfg.stem {
+		cands = dedupeLemmas(append(cands, lemma{porterStem(strings.ToLower(word)), "stem"}))
+	}
+	return cands
+}
+
+// inflectionNote explains a lemma fallback in the body, e.g. "running —
+// present participle of run". It is empty when the word matched as is.
+func inflectionNote(word, used string) string {
+	w := strings.ToLower(word)
+	if used == "" || used == w {
+		return ""
+	}
+	for _, c := range lemmaCandidates(w) {
+		if c.word == used && c.rule != "" {
+			return w + " — " + c.rule + " of " + used
+		}
+	}
+	return ""
+}
+
+// cacheKey namespaces non-English lookups (e.g. "es:casa") so languages don't
+// collide; English keeps the bare word to stay compatible with existing caches.
+func cacheKey(lang, word string) string {
+	w := strings.ToLower(word)
+	if lang == "" || lang == defaultLang {
+		return w
+	}
+	return lang + ":" + w
+}
+
 func cap1(s string) string {
 	if s == "" {
 		return s
 	}
-	return strings.ToUpper(s[:1]) + s[1:]
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[n:]
 }
 
 type diskEntry struct {
@@ -262,24 +1633,81 @@ type diskEntry struct {
 	Body   string    `json:"body"` // clamped
 	Full   string    `json:"full"` // full text
 	TS     time.Time `json:"ts"`
-	Source string    `json:"source"` // online|wiktionary|offline|none
+	Source string    `json:"source"`          // mw|online|wiktionary|offline|none
+	Lemma  string    `json:"lemma,omitempty"` // candidate that matched
+	Audio  string    `json:"audio,omitempty"` // pronunciation recording URL
+}
+
+// cacheVersion is the cache.json schema version. Bump it, and migrate in
+// decodeDiskCache, whenever diskEntry changes incompatibly.
+const cacheVersion = 1
+
+// errCacheNewer is a cache.json written by a newer define. It is neither
+// read nor overwritten.
+var errCacheNewer = errors.New("cache.json is from a newer version of define")
+
+// diskCacheFile is the layout of cache.json. Before versioning the file was
+// the bare entries map.
+type diskCacheFile struct {
+	Version int                  `json:"version"`
+	Entries map[string]diskEntry `json:"entries"`
 }
 
+// loadDiskCache reads cache.json for a read-only command; an unreadable or
+// newer file reads as empty. It never writes: an old-format file is
+// rewritten by the next flush of a diskCache.
 func loadDiskCache(path string) map[string]diskEntry {
+	m, _, _ := readDiskCache(path)
+	return m
+}
+
+// readDiskCache is loadDiskCache that also reports whether the file needs
+// rewriting in the current format, and why it couldn't be read.
+func readDiskCache(path string) (map[string]diskEntry, bool, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
-		return map[string]diskEntry{}
+		return map[string]diskEntry{}, false, err
+	}
+	m, migrated, err := decodeDiskCache(b)
+	if err != nil {
+		return map[string]diskEntry{}, false, err
+	}
+	return m, migrated, nil
+}
+
+// decodeDiskCache parses cache.json in either format, reporting whether it
+// was the old unversioned one. A top-level "version" number tells them
+// apart; in the old format every value is an entry object. A version past
+// cacheVersion is errCacheNewer.
+func decodeDiskCache(b []byte) (map[string]diskEntry, bool, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(b, &top); err != nil {
+		return nil, false, err
+	}
+	var v int
+	if raw, ok := top["version"]; ok && json.Unmarshal(raw, &v) == nil {
+		if v > cacheVersion {
+			return nil, false, errCacheNewer
+		}
+		var f diskCacheFile
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, false, err
+		}
+		if f.Entries == nil {
+			f.Entries = map[string]diskEntry{}
+		}
+		return f.Entries, false, nil
 	}
 	var m map[string]diskEntry
-	if json.Unmarshal(b, &m) != nil {
-		return map[string]diskEntry{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, false, err
 	}
-	return m
+	return m, true, nil
 }
 
 func saveDiskCacheAtomic(path string, m map[string]diskEntry) {
 	tmp := path + ".tmp"
-	b, err := json.Marshal(m)
+	b, err := json.Marshal(diskCacheFile{Version: cacheVersion, Entries: m})
 	if err != nil {
 		return
 	}
@@ -289,571 +1717,3903 @@ func saveDiskCacheAtomic(path string, m map[string]diskEntry) {
 	_ = os.Rename(tmp, path)
 }
 
-func writeLast(full string) {
-	_ = os.WriteFile(lastFilePath(), []byte(full), 0o600)
+// diskCache is cache.json loaded into memory and shared by concurrent
+// lookups; flush writes it back when something changed.
+type diskCache struct {
+	mu    sync.Mutex
+	path  string
+	m     map[string]diskEntry
+	dirty bool
+	max   int
+	now   func() time.Time
+
+	keep bool // the file is from a newer define: don't overwrite it
 }
 
-type cacheItem struct {
-	key   string
-	title string
-	body  string
-	full  string
-	ts    time.Time
-	src   string
+func openDiskCache(path string) *diskCache {
+	m, migrated, err := readDiskCache(path)
+	if errors.Is(err, errCacheNewer) {
+		fmt.Fprintf(os.Stderr, "define: %s: %v; not caching\n", path, err)
+	}
+	return &diskCache{path: path, m: m, dirty: migrated, max: diskCacheLimit(), now: time.Now, keep: errors.Is(err, errCacheNewer)}
 }
 
-type lruCache struct {
-	mu    sync.Mutex
-	ll    *list.List
-	items map[string]*list.Element
-	max   int
-	ttl   time.Duration
+// diskCacheLimit is DEFINE_CACHE_MAX, or diskCacheMax when unset or not a
+// positive integer.
+func diskCacheLimit() int {
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("DEFINE_CACHE_MAX"))); err == nil && n > 0 {
+		return n
+	}
+	return diskCacheMax
 }
 
-func newLRU(max int, ttl time.Duration) *lruCache {
-	return &lruCache{ll: list.New(), items: make(map[string]*list.Element, max), max: max, ttl: ttl}
+// pruneOldest drops the entries with the oldest TS until at most limit
+// are left, and returns how many it dropped.
+func pruneOldest(m map[string]diskEntry, limit int) int {
+	over := len(m) - limit
+	if over <= 0 {
+		return 0
+	}
+	keys := slices.Collect(maps.Keys(m))
+	slices.SortFunc(keys, func(a, b string) int { return m[a].TS.Compare(m[b].TS) })
+	for _, k := range keys[:over] {
+		delete(m, k)
+	}
+	return over
 }
 
-func (c *lruCache) get(key string) (cacheItem, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if el, ok := c.items[key]; ok {
-		it := el.Value.(*cacheItem)
-		if time.Since(it.ts) > c.ttl {
-			c.ll.Remove(el)
-			delete(c.items, key)
-			return cacheItem{}, false
-		}
-		c.ll.MoveToFront(el)
-		return *it, true
+func (d *diskCache) get(key string) (diskEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	de, ok := d.m[key]
+	return de, ok
+}
+
+// fresh is get for entries still within their diskEntryTTL.
+func (d *diskCache) fresh(key string) (diskEntry, bool) {
+	de, ok := d.get(key)
+	if !ok || expired(de, d.now()) {
+		return diskEntry{}, false
 	}
-	return cacheItem{}, false
+	return de, true
 }
 
-func (c *lruCache) set(key, title, body, full, src string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if el, ok := c.items[key]; ok {
-		it := el.Value.(*cacheItem)
-		it.title, it.body, it.full, it.ts, it.src = title, body, full, time.Now(), src
-		c.ll.MoveToFront(el)
-		return
+func (d *diskCache) set(key string, de diskEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m[key] = de
+	d.dirty = true
+}
+
+func (d *diskCache) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dirty && !d.keep {
+		if d.max > 0 {
+			pruneOldest(d.m, d.max)
+		}
+		saveDiskCacheAtomic(d.path, d.m)
+		d.dirty = false
 	}
-	el := c.ll.PushFront(&cacheItem{key: key, title: title, body: body, full: full, ts: time.Now(), src: src})
-	c.items[key] = el
-	for c.ll.Len() > c.max {
-		last := c.ll.Back()
-		if last == nil {
-			break
+}
+
+// compact drops the entries past their diskEntryTTL and returns how many
+// went. Without it cache.json would only ever grow.
+func (d *diskCache) compact() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	now := d.now()
+	for k, de := range d.m {
+		if expired(de, now) {
+			delete(d.m, k)
+			n++
 		}
-		old := last.Value.(*cacheItem)
-		c.ll.Remove(last)
-		delete(c.items, old.key)
 	}
+	if n > 0 {
+		d.dirty = true
+	}
+	return n
 }
 
-type dictAPIEntry struct {
-	Word     string `json:"word"`
-	Meanings []struct {
-		PartOfSpeech string `json:"partOfSpeech"`
-		Definitions  []struct {
-			Definition string `json:"definition"`
-			Example    string `json:"example"`
-		} `json:"definitions"`
-	} `json:"meanings"`
-}
-
-func lookupPrimary(client *http.Client, word string) (string, error) {
-	url := fmt.Sprintf(primaryAPI, word)
-	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
-	defer cancel()
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "define/1.0 (go)")
+// reset empties the cache and removes its files, returning how many
+// entries were dropped.
+func (d *diskCache) reset() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.m)
+	clear(d.m)
+	d.dirty, d.keep = false, false
+	removeCacheFiles()
+	return n
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// removeCacheFiles deletes the disk cache (including a leftover atomic-save
+// temp file) and the last definition.
+func removeCacheFiles() {
+	cache := cacheFilePath()
+	for _, f := range []string{cache, cache + ".tmp", lastFilePath()} {
+		_ = os.Remove(f)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", errors.New("non-2xx")
+}
+
+// clearCache wipes the caches, through the daemon when one is running so its
+// in-memory state goes too, and reports how many entries were removed.
+func clearCache() int {
+	n := 0
+	if reply, err := sendControl(ctrlClear); err == nil {
+		n, _ = strconv.Atoi(reply)
+	} else {
+		n = len(loadDiskCache(cacheFilePath()))
 	}
+	removeCacheFiles()
+	fmt.Printf("Removed %d cache entries.\n", n)
+	return 0
+}
 
-	var entries []dictAPIEntry
-	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
-		return "", err
+// compactCache drops expired entries from the disk cache, through the
+// daemon when one is running so it doesn't write them back.
+func compactCache() int {
+	n := 0
+	if reply, err := sendControl(ctrlCompact); err == nil {
+		n, _ = strconv.Atoi(reply)
+	} else {
+		disk := openDiskCache(cacheFilePath())
+		n = disk.compact()
+		disk.flush()
 	}
-	if len(entries) == 0 || len(entries[0].Meanings) == 0 {
-		return "", errors.New("no meanings")
+	fmt.Printf("Removed %d expired cache entries.\n", n)
+	return 0
+}
+
+// lastLookup is what last.txt records about the most recent lookup. Older
+// releases wrote only the full text there; readLast still accepts that.
+type lastLookup struct {
+	Word   string `json:"word,omitempty"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	Full   string `json:"full"`
+	Source string `json:"source"`
+}
+
+func writeLast(word string, de diskEntry) {
+	b, err := json.Marshal(lastLookup{Word: word, Title: de.Title, Body: de.Body, Full: de.Full, Source: de.Source})
+	if err != nil {
+		return
 	}
+	_ = os.WriteFile(lastFilePath(), b, 0o600)
+}
 
-	var b strings.Builder
-	added := 0
-	for _, m := range entries[0].Meanings {
-		if len(m.Definitions) == 0 {
-			continue
-		}
-		if added > 0 {
-			b.WriteString("\n\n")
-		}
-		if m.PartOfSpeech != "" {
-			b.WriteString(m.PartOfSpeech)
-			b.WriteString("\n")
-		}
-		d := m.Definitions[0]
-		if d.Definition != "" {
-			b.WriteString(d.Definition)
-		}
-		if d.Example != "" {
-			b.WriteString("\nExample: ")
-			b.WriteString(d.Example)
-		}
-		added++
-		if added >= 3 {
-			break
-		}
+func readLast() (lastLookup, bool) {
+	b, err := os.ReadFile(lastFilePath())
+	if err != nil {
+		return lastLookup{}, false
 	}
-	out := strings.TrimSpace(b.String())
-	if out == "" {
-		return "", errors.New("empty")
+	var ll lastLookup
+	if json.Unmarshal(b, &ll) == nil && ll.Full != "" {
+		return ll, true
 	}
-	return out, nil
+	return lastLookup{Full: string(b)}, true
 }
 
-type wiktionaryDef struct {
-	Definitions []string `json:"definitions"`
+type historyEntry struct {
+	Word   string    `json:"word"`
+	Source string    `json:"source"`
+	TS     time.Time `json:"ts"`
 }
 
-func lookupWiktionary(client *http.Client, word string) (string, error) {
-	url := fmt.Sprintf(wiktionaryAPI, word)
-	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
-	defer cancel()
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "define/1.0 (go)")
+// appendHistory records a lookup in history.jsonl. A repeat of the last
+// word within repeatWindow (a double-fired keybind) is not recorded again.
+func appendHistory(word, source string) {
+	path := historyFilePath()
+	now := time.Now()
+	if last, ok := lastHistoryEntry(path); ok && strings.EqualFold(last.Word, word) && now.Sub(last.TS) < repeatWindow() {
+		return
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Size() > historyMaxBytes {
+		trimHistory(path)
+	}
 
-	resp, err := client.Do(req)
+	b, err := json.Marshal(historyEntry{Word: word, Source: source, TS: now})
 	if err != nil {
-		return "", err
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", errors.New("non-2xx")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
 	}
+	defer f.Close()
+	_, _ = f.Write(append(b, '\n'))
+}
 
-	var payload map[string][]wiktionaryDef
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return "", err
+// lastHistoryEntry reads just the tail of the file to find the newest entry.
+func lastHistoryEntry(path string) (historyEntry, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return historyEntry{}, false
 	}
-	defs := payload["en"]
-	if len(defs) == 0 {
-		return "", errors.New("no en defs")
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return historyEntry{}, false
 	}
-
-	var b strings.Builder
-	count := 0
-	for _, bucket := range defs {
-		for _, d := range bucket.Definitions {
-			dd := strings.TrimSpace(d)
-			if dd == "" {
-				continue
-			}
-			if count > 0 {
-				b.WriteString("\n")
-			}
-			dd = strings.ReplaceAll(dd, "[", "")
-			dd = strings.ReplaceAll(dd, "]", "")
-			b.WriteString("• ")
-			b.WriteString(dd)
-			count++
-			if count >= 7 {
-				break
-			}
-		}
-		if count >= 7 {
-			break
-		}
+	off := max(fi.Size()-512, 0)
+	buf := make([]byte, fi.Size()-off)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return historyEntry{}, false
 	}
-	out := strings.TrimSpace(b.String())
-	if out == "" {
-		return "", errors.New("empty")
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	var he historyEntry
+	if json.Unmarshal([]byte(lines[len(lines)-1]), &he) != nil {
+		return historyEntry{}, false
 	}
-	return out, nil
+	return he, true
 }
 
-func normalizeOfflineLine(ln string) string {
-	ln = strings.TrimRight(ln, "\r")
-	ln = strings.TrimSpace(ln)
-	if ln == "" {
-		return ""
+// trimHistory drops the older half of the history file.
+func trimHistory(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
 	}
-	ln = wsCollapseRe.ReplaceAllString(ln, " ")
-	ln = bracketTagRe.ReplaceAllString(ln, "")
-	return strings.TrimSpace(ln)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	keep := strings.Join(lines[len(lines)/2:], "\n") + "\n"
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, []byte(keep), 0o600) != nil {
+		return
+	}
+	_ = os.Rename(tmp, path)
 }
 
-func offlineLookup(p paths, word string) (string, error) {
-	if p.dict == "" {
-		return "", errors.New("dict not installed")
-	}
-	cmd := exec.Command(p.dict, "-d", "gcide", word)
-	out, err := cmd.Output()
+func loadHistory(path string) []historyEntry {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		cmd = exec.Command(p.dict, "-m", word)
-		out, err = cmd.Output()
-		if err != nil {
-			return "", err
+		return nil
+	}
+	var out []historyEntry
+	for _, ln := range strings.Split(string(b), "\n") {
+		var he historyEntry
+		if json.Unmarshal([]byte(ln), &he) == nil && he.Word != "" {
+			out = append(out, he)
 		}
 	}
+	return out
+}
 
-	raw := strings.TrimSpace(string(out))
-	if raw == "" {
-		return "", errors.New("empty")
+// printHistory lists the last n lookups, newest first.
+func printHistory(n int) int {
+	hist := loadHistory(historyFilePath())
+	for i := len(hist) - 1; i >= 0 && i >= len(hist)-n; i-- {
+		he := hist[i]
+		fmt.Printf("%s  %-24s %s %s\n", he.TS.Local().Format("2006-01-02 15:04"), he.Word, sourceEmoji(he.Source), he.Source)
 	}
-	if strings.Contains(raw, "No definitions found for") || strings.Contains(raw, "perhaps you mean") {
-		return "", errors.New("no defs")
+	return 0
+}
+
+// missesMu serializes the read-modify-write of misses.txt between the
+// daemon's concurrent lookups.
+var missesMu sync.Mutex
+
+// recordMiss adds word to misses.txt unless it is already listed, keeping
+// only the newest missesMax words.
+func recordMiss(word string) {
+	missesMu.Lock()
+	defer missesMu.Unlock()
+	path := missesFilePath()
+	words := loadMisses(path)
+	if slices.ContainsFunc(words, func(w string) bool { return strings.EqualFold(w, word) }) {
+		return
+	}
+	words = append(words, strings.ToLower(word))
+	if len(words) > missesMax {
+		words = words[len(words)-missesMax:]
 	}
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, []byte(strings.Join(words, "\n")+"\n"), 0o600) == nil {
+		_ = os.Rename(tmp, path)
+	}
+}
 
-	lines := strings.Split(raw, "\n")
+func loadMisses(path string) []string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var words []string
+	for _, ln := range strings.Split(string(b), "\n") {
+		if ln = strings.TrimSpace(ln); ln != "" {
+			words = append(words, ln) // one per line; --phrase misses have spaces
+		}
+	}
+	return words
+}
 
-	clean := make([]string, 0, 48)
-	started := false
-	prevBlank := false
+func printMisses() int {
+	for _, w := range loadMisses(missesFilePath()) {
+		fmt.Println(w)
+	}
+	return 0
+}
 
-	for _, ln := range lines {
-		trim := strings.TrimSpace(ln)
+// bookmark is a saved lookup. It keeps the whole entry, so it still shows
+// in full after the cache has dropped the word.
+type bookmark struct {
+	Word     string    `json:"word"`
+	Title    string    `json:"title"`
+	Body     string    `json:"body"`
+	Full     string    `json:"full"`
+	Source   string    `json:"source"`
+	TS       time.Time `json:"ts"`                // when it was saved
+	Reviewed time.Time `json:"reviewed,omitzero"` // last shown by --review
+}
 
-		if strings.HasPrefix(ln, "From ") ||
-			strings.HasPrefix(ln, "Database") ||
-			strings.Contains(ln, "definition found") ||
-			strings.HasPrefix(ln, "Copyright") ||
-			strings.HasPrefix(ln, "dictd") ||
-			strings.HasPrefix(ln, "----") {
-			continue
+func (b bookmark) entry() diskEntry {
+	return diskEntry{Title: b.Title, Body: b.Body, Full: b.Full, Source: b.Source, TS: b.TS}
+}
+
+// loadBookmarks reads bookmarks.jsonl in the order the words were saved,
+// skipping lines that don't parse.
+func loadBookmarks(path string) []bookmark {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var out []bookmark
+	for _, ln := range bytes.Split(b, []byte("\n")) {
+		var bm bookmark
+		if json.Unmarshal(ln, &bm) == nil && bm.Word != "" {
+			out = append(out, bm)
 		}
-		if trim == "." {
-			continue
+	}
+	return out
+}
+
+func saveBookmarks(path string, bms []bookmark) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, bm := range bms {
+		if err := enc.Encode(bm); err != nil {
+			return err
 		}
-		if dbHeaderLineRe.MatchString(trim) && len(clean) == 0 {
-			continue
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// addBookmark saves word's entry. Words are kept once, ignoring case; saving
+// one again refreshes its entry and moves it to the end.
+func addBookmark(path, word string, de diskEntry, now time.Time) error {
+	bms := slices.DeleteFunc(loadBookmarks(path), func(bm bookmark) bool {
+		return strings.EqualFold(bm.Word, word)
+	})
+	bms = append(bms, bookmark{
+		Word:   strings.ToLower(word),
+		Title:  de.Title,
+		Body:   de.Body,
+		Full:   de.Full,
+		Source: de.Source,
+		TS:     now,
+	})
+	return saveBookmarks(path, bms)
+}
+
+// saveWord resolves word, bookmarks it and shows the notification as usual.
+// A word no source could define isn't saved.
+func saveWord(cfg config, p paths, word string) int {
+	de := resolveDirect(cfg, p, word)
+	if code := exitCode(de.Source); code != 0 {
+		fmt.Fprintf(os.Stderr, "define: no definition for %q, not saved\n", word)
+		return code
+	}
+	if err := addBookmark(bookmarksFilePath(), word, de, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, "define:", err)
+		return 1
+	}
+	de.Title = "🔖 " + de.Title
+	notifyDBusAndHandleClick(cfg, p, word, de)
+	return 0
+}
+
+func printBookmarks() int {
+	for _, bm := range loadBookmarks(bookmarksFilePath()) {
+		fmt.Printf("%s  %-24s %s %s\n", bm.TS.Local().Format("2006-01-02 15:04"), bm.Word, sourceEmoji(bm.Source), bm.Source)
+	}
+	return 0
+}
+
+// nextReview is the index of the bookmark to review next: one never
+// reviewed, else the one reviewed longest ago. It is -1 when there are none.
+func nextReview(bms []bookmark) int {
+	next := -1
+	for i, bm := range bms {
+		if next < 0 || bm.Reviewed.Before(bms[next].Reviewed) {
+			next = i
 		}
+	}
+	return next
+}
 
-		if trim == "" {
-			if started && !prevBlank && len(clean) > 0 {
-				clean = append(clean, "")
-				prevBlank = true
+// reviewBookmark shows the next bookmark due for review, so each --review
+// (say, from a keybind) steps through the whole list before repeating.
+func reviewBookmark(cfg config, p paths) int {
+	path := bookmarksFilePath()
+	bms := loadBookmarks(path)
+	i := nextReview(bms)
+	if i < 0 {
+		fmt.Fprintln(os.Stderr, "define: no bookmarks; save some with --save")
+		return 1
+	}
+	bms[i].Reviewed = time.Now()
+	if err := saveBookmarks(path, bms); err != nil {
+		fmt.Fprintln(os.Stderr, "define:", err)
+	}
+	notifyDBusAndHandleClick(cfg, p, bms[i].Word, bms[i].entry())
+	return 0
+}
+
+// exportRow is one word --export writes.
+type exportRow struct {
+	word, lang, source, text string
+	ts                       time.Time
+}
+
+// exportRows collects the rows --export writes, sorted by word. From the
+// cache only a word's plain entry counts: filtered (--pos), --all-sources and
+// offline-only variants would repeat it, and misses have nothing to learn.
+func exportRows(cfg config, now time.Time) []exportRow {
+	var rows []exportRow
+	if cfg.exportFrom == "bookmarks" {
+		for _, bm := range loadBookmarks(bookmarksFilePath()) {
+			rows = append(rows, exportRow{bm.Word, defaultLang, bm.Source, plainText(bm.entry()), bm.TS})
+		}
+	} else {
+		for key, de := range loadDiskCache(cacheFilePath()) {
+			if de.Source == "none" || strings.ContainsAny(key, "#+") {
+				continue
 			}
-			continue
+			lang, word, ok := strings.Cut(key, ":")
+			if !ok {
+				lang, word = defaultLang, key
+			}
+			rows = append(rows, exportRow{word, lang, de.Source, plainText(de), de.TS})
 		}
+	}
+	rows = slices.DeleteFunc(rows, func(r exportRow) bool {
+		return r.text == "" ||
+			(len(cfg.exportSrcs) > 0 && !slices.Contains(cfg.exportSrcs, r.source)) ||
+			(cfg.since > 0 && now.Sub(r.ts) > cfg.since)
+	})
+	slices.SortFunc(rows, func(a, b exportRow) int {
+		return cmp.Or(strings.Compare(a.word, b.word), strings.Compare(a.lang, b.lang))
+	})
+	return rows
+}
 
-		norm := normalizeOfflineLine(ln)
-		if norm == "" {
-			continue
+// plainText is an entry's definition without markup. The full text is plain
+// already; the notification body is Pango markup and clamped, so it is only
+// used, line by line through stripHTML, when an entry has no full text.
+func plainText(de diskEntry) string {
+	if de.Full != "" {
+		return strings.TrimSpace(de.Full)
+	}
+	var lines []string
+	for _, ln := range strings.Split(de.Body, "\n") {
+		lines = append(lines, stripHTML(ln))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// writeExport writes rows as cfg.export. Anki's importer reads fields as
+// HTML, so the anki format escapes the text and turns newlines into <br>;
+// the header lines tell it the separator. csv is RFC 4180 with a header row.
+func writeExport(w io.Writer, format string, rows []exportRow) error {
+	if format == "anki" {
+		bw := bufio.NewWriter(w)
+		fmt.Fprint(bw, "#separator:tab\n#html:true\n")
+		for _, r := range rows {
+			text := strings.ReplaceAll(markupEscaper.Replace(r.text), "\n", "<br>")
+			fmt.Fprintf(bw, "%s\t%s\n", ankiField(markupEscaper.Replace(r.word)), ankiField(text))
 		}
+		return bw.Flush()
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"word", "lang", "source", "definition", "fetched"})
+	for _, r := range rows {
+		_ = cw.Write([]string{r.word, r.lang, r.source, r.text, r.ts.UTC().Format(time.RFC3339)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
 
-		if !started {
-			if strings.HasPrefix(norm, "1.") ||
-				strings.HasPrefix(norm, "2.") ||
-				strings.HasPrefix(norm, "The ") ||
-				strings.HasPrefix(norm, "A ") ||
-				strings.HasPrefix(norm, "An ") {
-				started = true
-			} else {
+// ankiField keeps a field on its line: tabs would start a new field.
+func ankiField(s string) string { return strings.ReplaceAll(s, "\t", " ") }
+
+func exportEntries(cfg config, w io.Writer) int {
+	if err := writeExport(w, cfg.export, exportRows(cfg, time.Now())); err != nil {
+		fmt.Fprintln(os.Stderr, "define:", err)
+		return 1
+	}
+	return 0
+}
+
+// searchSnippet is how many runes of context --search shows around a match.
+const searchSnippet = 70
+
+type searchHit struct {
+	word, lang, snippet string
+}
+
+// searchRows returns the rows whose text contains q, ignoring case, with
+// the matching line cut down to a snippet around the first match. It scans
+// every row, which is quick for the ten thousand or so words a cache holds.
+func searchRows(rows []exportRow, q string) []searchHit {
+	lq := strings.ToLower(strings.Join(strings.Fields(q), " "))
+	if lq == "" {
+		return nil
+	}
+	var hits []searchHit
+	for _, row := range rows {
+		for _, ln := range strings.Split(row.text, "\n") {
+			ln = strings.TrimSpace(ln)
+			ll := strings.ToLower(ln)
+			i := strings.Index(ll, lq)
+			if i < 0 {
 				continue
 			}
+			// ToLower nearly always maps rune for rune; when it doesn't,
+			// the snippet just starts at the beginning of the line.
+			at := 0
+			if utf8.RuneCountInString(ll) == utf8.RuneCountInString(ln) {
+				at = utf8.RuneCountInString(ll[:i])
+			}
+			hits = append(hits, searchHit{row.word, row.lang, snippet(ln, at, utf8.RuneCountInString(lq))})
+			break
 		}
+	}
+	return hits
+}
 
-		clean = append(clean, norm)
-		prevBlank = false
-		if len(clean) >= 48 {
+// snippet cuts ln to searchSnippet runes keeping the n runes at rune offset
+// at, with a third of the spare room before them.
+func snippet(ln string, at, n int) string {
+	r := []rune(ln)
+	if len(r) <= searchSnippet {
+		return ln
+	}
+	start := max(at-(searchSnippet-n)/3, 0)
+	end := min(start+searchSnippet, len(r))
+	start = max(end-searchSnippet, 0)
+	out := string(r[start:end])
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(r) {
+		out += "…"
+	}
+	return out
+}
+
+// searchCache prints the cached words whose definition mentions q, one per
+// line with a snippet, and exits exitNotFound when none does.
+func searchCache(q string, w io.Writer) int {
+	hits := searchRows(exportRows(config{}, time.Now()), q)
+	for _, h := range hits {
+		word := h.word
+		if h.lang != defaultLang {
+			word = h.lang + ":" + word
+		}
+		fmt.Fprintf(w, "%-24s %s\n", word, h.snippet)
+	}
+	if len(hits) == 0 {
+		return exitNotFound
+	}
+	return 0
+}
+
+type cacheItem struct {
+	key   string
+	entry diskEntry
+	ts    time.Time
+}
+
+type lruCache struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	max   int
+	ttl   time.Duration
+	now   func() time.Time
+
+	hits, misses, evictions atomic.Int64
+}
+
+type lruStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"` // entries dropped for capacity
+	Size      int   `json:"size"`
+}
+
+func newLRU(max int, ttl time.Duration) *lruCache {
+	return &lruCache{ll: list.New(), items: make(map[string]*list.Element, max), max: max, ttl: ttl, now: time.Now}
+}
+
+func (c *lruCache) get(key string) (diskEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*cacheItem)
+		now := c.now()
+		if now.Sub(it.ts) > c.ttl || (it.entry.Source == "none" && now.Sub(it.entry.TS) > negativeTTL) {
+			c.ll.Remove(el)
+			delete(c.items, key)
+			c.misses.Add(1)
+			return diskEntry{}, false
+		}
+		c.ll.MoveToFront(el)
+		c.hits.Add(1)
+		return it.entry, true
+	}
+	c.misses.Add(1)
+	return diskEntry{}, false
+}
+
+func (c *lruCache) stats() lruStats {
+	return lruStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      c.len(),
+	}
+}
+
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *lruCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+}
+
+func (c *lruCache) set(key string, e diskEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*cacheItem)
+		it.entry, it.ts = e, c.now()
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&cacheItem{key: key, entry: e, ts: c.now()})
+	c.items[key] = el
+	for c.ll.Len() > c.max {
+		last := c.ll.Back()
+		if last == nil {
 			break
 		}
+		old := last.Value.(*cacheItem)
+		c.ll.Remove(last)
+		delete(c.items, old.key)
+		c.evictions.Add(1)
 	}
+}
 
-	outStr := strings.TrimSpace(strings.Join(clean, "\n"))
-	if outStr == "" {
-		return "", errors.New("no usable offline content")
+// httpTimeout is the per-lookup budget: DEFINE_HTTP_TIMEOUT (a Go duration,
+// capped at apiTimeoutMax) or apiTimeout when unset or unparseable.
+func httpTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("DEFINE_HTTP_TIMEOUT")); err == nil && d > 0 {
+		return min(d, apiTimeoutMax)
 	}
-	return outStr, nil
+	return apiTimeout
+}
+
+// envDuration reads a Go duration from the environment: def when unset,
+// unparseable or not positive, else clamped to lo..hi.
+func envDuration(name string, def, lo, hi time.Duration) time.Duration {
+	if d, err := time.ParseDuration(strings.TrimSpace(os.Getenv(name))); err == nil && d > 0 {
+		return min(max(d, lo), hi)
+	}
+	return def
+}
+
+// cacheLifetime is how long online answers stay cached (DEFINE_CACHE_TTL).
+func cacheLifetime() time.Duration {
+	return envDuration("DEFINE_CACHE_TTL", cacheTTL, cacheTTLMin, cacheTTLMax)
+}
+
+// offlineRefresh is how long an offline answer is kept before the online
+// sources are tried again (DEFINE_OFFLINE_REFRESH).
+func offlineRefresh() time.Duration {
+	return envDuration("DEFINE_OFFLINE_REFRESH", offlineRefreshAfter, offlineRefreshMin, cacheTTLMax)
+}
+
+// repeatWindow is how soon a repeat of the same word counts as a double
+// trigger and is dropped (DEFINE_DEDUPE_WINDOW).
+func repeatWindow() time.Duration {
+	return envDuration("DEFINE_DEDUPE_WINDOW", dedupeWindow, time.Millisecond, dedupeWindowMax)
+}
+
+// envLimit reads a result count from the environment: def when unset or not
+// a positive integer, and never more than limitMax.
+func envLimit(name string, def int) int {
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv(name))); err == nil && n > 0 {
+		return min(n, limitMax)
+	}
+	return def
+}
+
+// newHTTPClient is the client for all API requests, in the daemon and in
+// direct mode alike, so both reuse connections the same way.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        64,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+		DialContext:         dialContext(),
+		TLSClientConfig:     tlsConfig(),
+	}}
+}
+
+// tlsConfig is the TLS setup for API requests: certificates are verified
+// as usual, against at least TLS 1.2 (DEFINE_TLS_MIN=1.3 raises it), and
+// the hosts in DEFINE_TLS_PINS must also present one of the listed keys.
+func tlsConfig() *tls.Config {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if strings.TrimSpace(os.Getenv("DEFINE_TLS_MIN")) == "1.3" {
+		c.MinVersion = tls.VersionTLS13
+	}
+	if pins := parsePins(os.Getenv("DEFINE_TLS_PINS")); len(pins) > 0 {
+		c.VerifyConnection = verifyPins(pins)
+	}
+	return c
 }
 
-func clampBody(s string) string {
-	s = strings.TrimSpace(s)
-	if len(s) <= bodyMaxChars {
-		return s
-	}
-	head := s[:bodyMaxChars-80]
-	return strings.TrimSpace(head) + "\n\n… (click to open full)"
-}
+// parsePins reads DEFINE_TLS_PINS: space- or comma-separated host=pin
+// pairs, where a pin is the base64 SHA-256 of a certificate's public key
+// (SubjectPublicKeyInfo), optionally prefixed "sha256/". Repeating a host
+// allows several keys, e.g. a backup. Malformed entries are reported and
+// skipped.
+func parsePins(v string) map[string][]string {
+	pins := map[string][]string{}
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		host, pin, ok := strings.Cut(f, "=")
+		pin = strings.TrimPrefix(pin, "sha256/")
+		if b, err := base64.StdEncoding.DecodeString(pin); !ok || host == "" || err != nil || len(b) != sha256.Size {
+			fmt.Fprintf(os.Stderr, "define: DEFINE_TLS_PINS: ignoring %q, want host=sha256/BASE64\n", f)
+			continue
+		}
+		host = strings.ToLower(host)
+		pins[host] = append(pins[host], pin)
+	}
+	return pins
+}
+
+// spkiPin is the pin of cert's public key, as parsePins expects it.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins checks, after the usual verification, that a pinned host's
+// chain holds one of its keys. Hosts without pins pass.
+func verifyPins(pins map[string][]string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		want := pins[strings.ToLower(cs.ServerName)]
+		if len(want) == 0 {
+			return nil
+		}
+		// A pin may be for the leaf or for an issuer in any verified chain.
+		certs := slices.Concat(append([][]*x509.Certificate{cs.PeerCertificates}, cs.VerifiedChains...)...)
+		for _, cert := range certs {
+			if slices.Contains(want, spkiPin(cert)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("tls: %s presented no key pinned in DEFINE_TLS_PINS", cs.ServerName)
+	}
+}
+
+// warmUp opens a connection to each host in the background so a later
+// request there skips the TCP and TLS handshakes. Errors are ignored.
+func warmUp(client *http.Client, hosts ...string) {
+	for _, h := range hosts {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), httpTimeout())
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+h+"/", nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("User-Agent", httpUserAgent())
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+}
+
+// apiHost is the host part of one of the API URL formats.
+func apiHost(format string) string {
+	_, rest, _ := strings.Cut(format, "://")
+	host, _, _ := strings.Cut(rest, "/")
+	return host
+}
+
+// dialContext connects with a short timeout so a stalled address (typically
+// broken IPv6) can't eat the whole lookup budget. DEFINE_FORCE_IPV4=1 skips
+// IPv6 entirely.
+func dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	if v4, _ := strconv.ParseBool(os.Getenv("DEFINE_FORCE_IPV4")); v4 {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network == "tcp" || network == "tcp6" {
+				network = "tcp4"
+			}
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+	return d.DialContext
+}
+
+// envBodyMax is DEFINE_BODY_MAX clamped to bodyMaxMin..bodyMaxMax, or
+// bodyMaxChars when unset or not a number.
+func envBodyMax() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("DEFINE_BODY_MAX")))
+	if err != nil {
+		return bodyMaxChars
+	}
+	return min(max(n, bodyMaxMin), bodyMaxMax)
+}
+
+func httpUserAgent() string {
+	if ua := strings.TrimSpace(os.Getenv("DEFINE_USER_AGENT")); ua != "" {
+		return ua
+	}
+	return userAgent
+}
+
+// maxLookups is how many lookups the daemon runs at once: DEFINE_MAX_LOOKUPS
+// or lookupsDefault when unset or not a positive integer.
+func maxLookups() int {
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("DEFINE_MAX_LOOKUPS"))); err == nil && n > 0 {
+		return n
+	}
+	return lookupsDefault
+}
+
+// getWithRetry GETs url, retrying connection errors and 429/5xx responses
+// with backoff. Waits never run past ctx's deadline, so the caller's timeout
+// stays the overall budget. Other responses are returned as-is.
+func getWithRetry(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("User-Agent", httpUserAgent())
+
+		// Wait fails at once if the wait would run past ctx's deadline, so
+		// a throttled source is skipped rather than eating the budget.
+		if err := hostLimiter(req.URL.Host).Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= len(retryBackoff) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		wait := retryBackoff[attempt]
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			if ra, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = min(ra, retryAfterMax)
+			}
+		}
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) <= wait {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// statusError is a non-2xx API response.
+type statusError int
+
+func (e statusError) Error() string { return fmt.Sprintf("non-2xx: %d", int(e)) }
+
+// isOutage reports whether err means the source itself is unreachable or
+// failing (network errors, timeouts, 429/5xx), as opposed to it answering
+// that it has no definition.
+func isOutage(err error) bool {
+	var se statusError
+	if errors.As(err, &se) {
+		return se == http.StatusTooManyRequests || se >= 500
+	}
+	var ue *url.Error
+	return errors.As(err, &ue) || errors.Is(err, context.DeadlineExceeded)
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*rate.Limiter{}
+)
+
+// hostLimiter returns the limiter shared by every request to host. The rate
+// is DEFINE_RATE_LIMIT requests per second (rateDefault when unset or not a
+// positive number), with a burst of the same size.
+func hostLimiter(host string) *rate.Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	if l, ok := limiters[host]; ok {
+		return l
+	}
+	rps := float64(rateDefault)
+	if v, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv("DEFINE_RATE_LIMIT")), 64); err == nil && v > 0 {
+		rps = v
+	}
+	l := rate.NewLimiter(rate.Limit(rps), max(int(rps), 1))
+	limiters[host] = l
+	return l
+}
+
+// parseRetryAfter accepts both forms of the header: delay-seconds and an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+type dictAPIEntry struct {
+	Word      string `json:"word"`
+	Phonetic  string `json:"phonetic"`
+	Phonetics []struct {
+		Text  string `json:"text"`
+		Audio string `json:"audio"`
+	} `json:"phonetics"`
+	Meanings []dictAPIMeaning `json:"meanings"`
+}
+
+type dictAPIMeaning struct {
+	PartOfSpeech string `json:"partOfSpeech"`
+	Definitions  []struct {
+		Definition string `json:"definition"`
+		Example    string `json:"example"`
+	} `json:"definitions"`
+}
+
+// pronunciation is the IPA text, e.g. "/məˈʃiːn/": the top-level phonetic,
+// else the first non-empty phonetics[].text.
+func (e dictAPIEntry) pronunciation() string {
+	if ph := strings.TrimSpace(e.Phonetic); ph != "" {
+		return ph
+	}
+	for _, p := range e.Phonetics {
+		if ph := strings.TrimSpace(p.Text); ph != "" {
+			return ph
+		}
+	}
+	return ""
+}
+
+// audioURL is the first pronunciation recording, if any.
+func (e dictAPIEntry) audioURL() string {
+	for _, p := range e.Phonetics {
+		a := strings.TrimSpace(p.Audio)
+		if a == "" {
+			continue
+		}
+		if strings.HasPrefix(a, "//") {
+			a = "https:" + a
+		}
+		return a
+	}
+	return ""
+}
+
+// lookupPrimary returns the formatted definition and, when the API has one,
+// a pronunciation audio URL. Each meaning shows its first definition and up
+// to maxExamples example sentences drawn from all of its definitions. A 0
+// count means the default; noExamples shows none.
+func lookupPrimary(ctx context.Context, client *http.Client, lang, word, pos string, maxMeanings, maxExamples int) (string, string, error) {
+	maxMeanings = cmp.Or(maxMeanings, meaningsDefault)
+	maxExamples = cmp.Or(maxExamples, examplesDefault)
+	url := fmt.Sprintf(primaryAPI, lang, url.PathEscape(word))
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout())
+	defer cancel()
+
+	resp, err := getWithRetry(ctx, client, url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", "", statusError(resp.StatusCode)
+	}
+
+	var entries []dictAPIEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", "", err
+	}
+	if len(entries) == 0 || len(entries[0].Meanings) == 0 {
+		return "", "", errors.New("no meanings")
+	}
+
+	var b strings.Builder
+	if ph := entries[0].pronunciation(); ph != "" {
+		b.WriteString(ph)
+		b.WriteString("\n")
+	}
+	meanings := filterPOS(entries[0].Meanings, pos, func(m dictAPIMeaning) string { return m.PartOfSpeech })
+	added := 0
+	for _, m := range meanings {
+		if len(m.Definitions) == 0 {
+			continue
+		}
+		if added > 0 {
+			b.WriteString("\n\n")
+		}
+		if m.PartOfSpeech != "" {
+			b.WriteString(m.PartOfSpeech)
+			b.WriteString("\n")
+		}
+		if d := m.Definitions[0]; d.Definition != "" {
+			b.WriteString(d.Definition)
+		}
+		var examples []string
+		for _, d := range m.Definitions {
+			if len(examples) >= maxExamples {
+				break
+			}
+			if ex := strings.TrimSpace(d.Example); ex != "" {
+				examples = append(examples, ex)
+			}
+		}
+		switch len(examples) {
+		case 0:
+		case 1:
+			b.WriteString("\nExample: ")
+			b.WriteString(examples[0])
+		default:
+			b.WriteString("\nExamples:")
+			for _, ex := range examples {
+				b.WriteString("\n• ")
+				b.WriteString(ex)
+			}
+		}
+		added++
+		if added >= maxMeanings {
+			break
+		}
+	}
+	out := strings.TrimSpace(b.String())
+	if added == 0 || out == "" {
+		return "", "", errors.New("empty")
+	}
+	return out, entries[0].audioURL(), nil
+}
+
+type mwEntry struct {
+	Meta struct {
+		ID string `json:"id"` // headword, optionally with a homograph suffix like "legend:1"
+	} `json:"meta"`
+	FL       string   `json:"fl"`
+	Lbs      []string `json:"lbs"` // general labels: "informal", "chiefly British"
+	Sls      []string `json:"sls"` // subject/status labels: "slang", "archaic"
+	Shortdef []string `json:"shortdef"`
+}
+
+// mwAPIKey is the Merriam-Webster Collegiate key; the source is skipped without one.
+func mwAPIKey() string { return strings.TrimSpace(os.Getenv("DEFINE_MW_KEY")) }
+
+func lookupMerriamWebster(ctx context.Context, client *http.Client, word, pos string, maxMeanings int) (string, error) {
+	maxMeanings = cmp.Or(maxMeanings, meaningsDefault)
+	key := mwAPIKey()
+	if key == "" {
+		return "", errors.New("no DEFINE_MW_KEY")
+	}
+	url := fmt.Sprintf(mwAPI, url.PathEscape(word), url.QueryEscape(key))
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout())
+	defer cancel()
+
+	resp, err := getWithRetry(ctx, client, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", statusError(resp.StatusCode)
+	}
+
+	// Unknown words come back as an array of suggestion strings rather than
+	// entry objects, so decode element by element and skip anything else.
+	var raw []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return "", err
+	}
+	var entries []mwEntry
+	for _, r := range raw {
+		var e mwEntry
+		if json.Unmarshal(r, &e) == nil && len(e.Shortdef) > 0 {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return "", errors.New("no entries")
+	}
+
+	// Prefer entries for the headword itself over run-ons like "legendary".
+	var exact []mwEntry
+	for _, e := range entries {
+		id, _, _ := strings.Cut(e.Meta.ID, ":")
+		if strings.EqualFold(id, word) {
+			exact = append(exact, e)
+		}
+	}
+	if len(exact) > 0 {
+		entries = exact
+	}
+	entries = filterPOS(entries, pos, func(e mwEntry) string { return e.FL })
+
+	var b strings.Builder
+	added := 0
+	for _, e := range entries {
+		if added > 0 {
+			b.WriteString("\n\n")
+		}
+		if head := withLabels(e.FL, slices.Concat(e.Lbs, e.Sls)); head != "" {
+			b.WriteString(head)
+			b.WriteString("\n")
+		}
+		b.WriteString(e.Shortdef[0])
+		added++
+		if added >= maxMeanings {
+			break
+		}
+	}
+	out := strings.TrimSpace(b.String())
+	if out == "" {
+		return "", errors.New("empty")
+	}
+	return out, nil
+}
+
+type wiktionaryDef struct {
+	PartOfSpeech string `json:"partOfSpeech"`
+	Language     string `json:"language"`
+	Definitions  []struct {
+		Definition string `json:"definition"` // HTML fragment
+	} `json:"definitions"`
+}
+
+// lookupWiktionary returns the definitions of word in lang and the language
+// section they came from (see parseWiktionary).
+func lookupWiktionary(ctx context.Context, client *http.Client, lang, word, pos string, maxDefs int, anyLang bool) (string, string, error) {
+	url := fmt.Sprintf(wiktionaryAPI, url.PathEscape(word))
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout())
+	defer cancel()
+
+	resp, err := getWithRetry(ctx, client, url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", "", statusError(resp.StatusCode)
+	}
+
+	return parseWiktionary(resp.Body, lang, pos, maxDefs, anyLang)
+}
+
+// parseWiktionary formats the definitions for lang from a REST payload as
+// up to maxDefs bullets. The payload has one key per language section, each
+// with one bucket per part of speech. With anyLang, a word with no lang
+// section is read from the richest other one, whose name then heads the
+// text; used is the code of the section read.
+func parseWiktionary(r io.Reader, lang, pos string, maxDefs int, anyLang bool) (text, used string, err error) {
+	var payload map[string][]wiktionaryDef
+	if err := json.NewDecoder(r).Decode(&payload); err != nil {
+		return "", "", err
+	}
+	used = lang
+	defs := payload[lang]
+	if len(defs) == 0 && anyLang {
+		most := 0
+		for _, code := range slices.Sorted(maps.Keys(payload)) {
+			n := 0
+			for _, bucket := range payload[code] {
+				n += len(bucket.Definitions)
+			}
+			if n > most {
+				used, most = code, n
+			}
+		}
+		defs = payload[used]
+	}
+	if len(defs) == 0 {
+		return "", "", fmt.Errorf("no %s defs", lang)
+	}
+	text, err = formatWiktionary(defs, pos, maxDefs)
+	if err == nil && used != lang {
+		name := cmp.Or(defs[0].Language, used)
+		text = "From the " + name + " section:\n" + text
+	}
+	return text, used, err
+}
+
+func formatWiktionary(defs []wiktionaryDef, pos string, maxDefs int) (string, error) {
+	maxDefs = cmp.Or(maxDefs, defsDefault)
+	defs = filterPOS(defs, pos, func(d wiktionaryDef) string { return d.PartOfSpeech })
+
+	var b strings.Builder
+	count := 0
+	for _, bucket := range defs {
+		for _, d := range bucket.Definitions {
+			dd, labels := wiktionaryLabels(d.Definition)
+			dd = strings.ReplaceAll(dd, "[", "")
+			dd = strings.ReplaceAll(dd, "]", "")
+			if dd == "" {
+				continue
+			}
+			if count > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString("• ")
+			if len(labels) > 0 {
+				b.WriteString(withLabels(strings.ToLower(bucket.PartOfSpeech), labels))
+				b.WriteString(": ")
+			}
+			b.WriteString(dd)
+			count++
+			if count >= maxDefs {
+				break
+			}
+		}
+		if count >= maxDefs {
+			break
+		}
+	}
+	out := strings.TrimSpace(b.String())
+	if out == "" {
+		return "", errors.New("empty")
+	}
+	return out, nil
+}
+
+// wiktionaryLabels strips a definition's HTML and splits off its leading
+// sense labels, which Wiktionary renders as "(informal, slang) ...".
+func wiktionaryLabels(def string) (string, []string) {
+	var labels []string
+	for _, m := range wiktLabelRe.FindAllStringSubmatch(def, -1) {
+		for _, l := range strings.Split(stripHTML(m[1]), ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				labels = append(labels, l)
+			}
+		}
+	}
+	text := stripHTML(def)
+	if len(labels) > 0 && strings.HasPrefix(text, "(") {
+		if _, rest, ok := strings.Cut(text, ")"); ok {
+			text = strings.TrimSpace(rest)
+		}
+	}
+	return text, labels
+}
+
+// withLabels tags a part of speech with its register labels, as in
+// "noun (informal)". Either side may be empty.
+func withLabels(pos string, labels []string) string {
+	if len(labels) == 0 {
+		return pos
+	}
+	return strings.TrimSpace(pos + " (" + strings.Join(labels, ", ") + ")")
+}
+
+// filterPOS keeps the items whose part-of-speech label (e.g. "noun",
+// "transitive verb", "Proper noun") includes pos as a word. No pos, or a
+// filter that matches nothing, returns items unchanged.
+func filterPOS[T any](items []T, pos string, label func(T) string) []T {
+	if pos == "" {
+		return items
+	}
+	var out []T
+	for _, it := range items {
+		if slices.Contains(strings.Fields(strings.ToLower(label(it))), pos) {
+			out = append(out, it)
+		}
+	}
+	if len(out) == 0 {
+		return items
+	}
+	return out
+}
+
+// stripHTML turns a Wiktionary HTML fragment into plain text: tags are
+// dropped, entities decoded and whitespace collapsed. Tags go first so an
+// escaped "&lt;b&gt;" survives as literal text.
+func stripHTML(s string) string {
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return strings.TrimSpace(wsCollapseRe.ReplaceAllString(s, " "))
+}
+
+type datamuseWord struct {
+	Word string   `json:"word"`
+	Defs []string `json:"defs"` // "pos\tdefinition", only with md=d
+}
+
+func getDatamuse(ctx context.Context, client *http.Client, url string) ([]datamuseWord, error) {
+	resp, err := getWithRetry(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, statusError(resp.StatusCode)
+	}
+
+	var res []datamuseWord
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// lookupDatamuse returns up to max words related to word by rel
+// (e.g. "rel_syn", "rel_ant").
+func lookupDatamuse(ctx context.Context, client *http.Client, rel, word string, max int) ([]string, error) {
+	res, err := getDatamuse(ctx, client, fmt.Sprintf(datamuseAPI, rel, url.QueryEscape(word), max))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(res))
+	for _, r := range res {
+		if w := strings.TrimSpace(r.Word); w != "" {
+			out = append(out, w)
+		}
+		if len(out) >= max {
+			break
+		}
+	}
+	return out, nil
+}
+
+// lookupThesaurus fetches synonyms and antonyms concurrently under a short
+// deadline and formats them as labeled lines. Whatever isn't back in time
+// is skipped, so this never costs more than thesaurusTimeout.
+func lookupThesaurus(ctx context.Context, client *http.Client, word string) string {
+	ctx, cancel := context.WithTimeout(ctx, thesaurusTimeout)
+	defer cancel()
+
+	var syn, ant []string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		syn, _ = lookupDatamuse(ctx, client, "rel_syn", word, thesaurusMax)
+	}()
+	go func() {
+		defer wg.Done()
+		ant, _ = lookupDatamuse(ctx, client, "rel_ant", word, thesaurusMax)
+	}()
+	wg.Wait()
+
+	var lines []string
+	if len(syn) > 0 {
+		lines = append(lines, "Synonyms: "+strings.Join(syn, ", "))
+	}
+	if len(ant) > 0 {
+		lines = append(lines, "Antonyms: "+strings.Join(ant, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lookupEtymology fetches the English etymology of word from the plain-text
+// Wiktionary page extract. Like the thesaurus it is best-effort and bounded
+// by etymologyTimeout; an empty string means there was none in time.
+func lookupEtymology(ctx context.Context, client *http.Client, word string) string {
+	ctx, cancel := context.WithTimeout(ctx, etymologyTimeout)
+	defer cancel()
+
+	resp, err := getWithRetry(ctx, client, fmt.Sprintf(extractAPI, url.QueryEscape(word)))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ""
+	}
+	var res struct {
+		Query struct {
+			Pages map[string]struct {
+				Extract string `json:"extract"`
+			} `json:"pages"`
+		} `json:"query"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&res) != nil {
+		return ""
+	}
+	for _, pg := range res.Query.Pages {
+		if ety := parseEtymology(pg.Extract); ety != "" {
+			return ety
+		}
+	}
+	return ""
+}
+
+// parseEtymology returns the first Etymology section under "== English =="
+// in a page extract, as one line. Headings look like "=== Etymology 1 ===".
+func parseEtymology(extract string) string {
+	english, inEty := false, false
+	var parts []string
+	for _, ln := range strings.Split(extract, "\n") {
+		t := strings.TrimSpace(ln)
+		if strings.HasPrefix(t, "==") {
+			if inEty {
+				break
+			}
+			level := len(t) - len(strings.TrimLeft(t, "="))
+			name := strings.TrimSpace(strings.Trim(t, "="))
+			if level == 2 {
+				english = name == "English"
+			} else if english && strings.HasPrefix(name, "Etymology") {
+				inEty = true
+			}
+			continue
+		}
+		if inEty && t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.TrimSpace(wsCollapseRe.ReplaceAllString(strings.Join(parts, " "), " "))
+}
+
+// lookupSuggestions asks Datamuse for similarly spelled words. It is
+// best-effort: any failure or a slow answer just means no suggestions.
+func lookupSuggestions(ctx context.Context, client *http.Client, word string) []string {
+	ctx, cancel := context.WithTimeout(ctx, suggestTimeout)
+	defer cancel()
+	words, err := lookupDatamuse(ctx, client, "sp", word, suggestMax+1)
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, suggestMax)
+	for _, w := range words {
+		if !strings.EqualFold(w, word) && len(out) < suggestMax {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// lookupMeans asks Datamuse for up to max words whose meaning is like the
+// description, each with its dictionary definitions.
+func lookupMeans(ctx context.Context, client *http.Client, description string, max int) ([]datamuseWord, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout())
+	defer cancel()
+	res, err := getDatamuse(ctx, client, fmt.Sprintf(datamuseAPI, "ml", url.QueryEscape(description), max)+"&md=d")
+	if err != nil {
+		return nil, err
+	}
+	res = slices.DeleteFunc(res, func(w datamuseWord) bool { return strings.TrimSpace(w.Word) == "" })
+	return res[:min(len(res), max)], nil
+}
+
+// datamuseDef turns a Datamuse "n\tdefinition" into "(n) definition".
+func datamuseDef(d string) string {
+	if pos, def, ok := strings.Cut(d, "\t"); ok {
+		return "(" + pos + ") " + strings.TrimSpace(def)
+	}
+	return strings.TrimSpace(d)
+}
+
+// meansEntry formats --means candidates: the notification lists the first
+// meansShown with their first definition, the full view every candidate
+// with all of its definitions.
+func meansEntry(cfg config, description string, words []datamuseWord) diskEntry {
+	title := "🔎 " + cap1(description)
+	if len(words) == 0 {
+		full := "No words found meaning “" + description + "”."
+		return diskEntry{Title: title, Body: markupEscaper.Replace(full), Full: full, TS: time.Now(), Source: "none"}
+	}
+	var short, full []string
+	for i, w := range words {
+		line := "• " + w.Word
+		if len(w.Defs) > 0 {
+			line += " — " + datamuseDef(w.Defs[0])
+		}
+		if i < meansShown {
+			short = append(short, line)
+		}
+		full = append(full, w.Word)
+		for _, d := range w.Defs {
+			full = append(full, "  "+datamuseDef(d))
+		}
+	}
+	return diskEntry{
+		Title:  title,
+		Body:   markupEscaper.Replace(clampBody(strings.Join(short, "\n"), cfg.bodyMax)),
+		Full:   "Words meaning “" + description + "”:\n\n" + strings.Join(full, "\n"),
+		TS:     time.Now(),
+		Source: "datamuse",
+	}
+}
+
+// defineByMeaning is --means: a reverse lookup from a description to words.
+// The description is free text, so it skips validWord and the caches.
+func defineByMeaning(cfg config, p paths, args []string) int {
+	description := strings.Join(args, " ")
+	if description == "" {
+		description = getSelectedText(cfg, p)
+	}
+	description = strings.Join(strings.Fields(description), " ")
+	if description == "" {
+		return exitNoInput
+	}
+	if r := []rune(description); len(r) > meansMaxLen {
+		description = string(r[:meansMaxLen])
+	}
+	words, err := lookupMeans(context.Background(), newHTTPClient(), description, meansMax)
+	if err != nil {
+		debugf(cfg, "means %q: %v", description, err)
+	}
+	de := meansEntry(cfg, description, words)
+	writeLast(description, de)
+	notifyDBusAndHandleClick(cfg, p, description, de)
+	return exitCode(de.Source)
+}
+
+func normalizeOfflineLine(ln string) string {
+	ln = strings.TrimRight(ln, "\r")
+	ln = strings.TrimSpace(ln)
+	if ln == "" {
+		return ""
+	}
+	ln = wsCollapseRe.ReplaceAllString(ln, " ")
+	ln = bracketTagRe.ReplaceAllString(ln, "")
+	return strings.TrimSpace(ln)
+}
+
+// dictDBs is the comma-separated DEFINE_DICT_DBS list (e.g. "wn,gcide"),
+// or defaultDictDBs. Names that could be mistaken for flags are dropped.
+func dictDBs() []string {
+	var dbs []string
+	for _, db := range strings.Split(os.Getenv("DEFINE_DICT_DBS"), ",") {
+		db = strings.TrimSpace(db)
+		if dbNameRe.MatchString(db) && !strings.HasPrefix(db, "-") {
+			dbs = append(dbs, db)
+		}
+	}
+	if len(dbs) == 0 {
+		return defaultDictDBs
+	}
+	return dbs
+}
+
+// glossary is custom.json, a JSON object of word → definition, reloaded
+// whenever the file's modification time or size changes.
+type glossary struct {
+	mu      sync.Mutex
+	path    func() string
+	modTime time.Time
+	fsize   int64
+	m       map[string]string // keys lowercased
+}
+
+var customGlossary = &glossary{path: customFilePath}
+
+// load returns the current entries, re-reading the file if it changed. A
+// missing or malformed file means no entries.
+func (g *glossary) load() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fi, err := os.Stat(g.path())
+	if err != nil {
+		g.m, g.modTime, g.fsize = nil, time.Time{}, 0
+		return nil
+	}
+	if g.m != nil && fi.ModTime().Equal(g.modTime) && fi.Size() == g.fsize {
+		return g.m
+	}
+	g.modTime, g.fsize = fi.ModTime(), fi.Size()
+	g.m = map[string]string{}
+	b, err := os.ReadFile(g.path())
+	if err != nil {
+		return g.m
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		fmt.Fprintf(os.Stderr, "define: %s: %v\n", g.path(), err)
+		return g.m
+	}
+	for w, def := range raw {
+		if def = strings.TrimSpace(def); def != "" {
+			g.m[strings.ToLower(strings.TrimSpace(w))] = def
+		}
+	}
+	return g.m
+}
+
+func (g *glossary) size() int { return len(g.load()) }
+
+// inGlossary reports whether the custom source is in the lookup order and
+// has an entry for word.
+func inGlossary(cfg config, word string) bool {
+	order := cfg.sources
+	if order == nil {
+		order = defaultSources
+	}
+	if !slices.Contains(order, "custom") {
+		return false
+	}
+	_, err := lookupCustom(word)
+	return err == nil
+}
+
+// lookupCustom finds word in the user's glossary, ignoring case.
+func lookupCustom(word string) (string, error) {
+	if def, ok := customGlossary.load()[strings.ToLower(word)]; ok {
+		return def, nil
+	}
+	return "", errors.New("not in custom.json")
+}
+
+// offlineLookup queries each dict database in dictDBs order, then falls
+// back to dict's default match strategy, returning the first usable answer.
+func offlineLookup(p paths, word string) (string, error) {
+	if p.dict == "" {
+		return "", errors.New("dict not installed")
+	}
+	dbs := dictDBs()
+	args := make([][]string, 0, len(dbs)+1)
+	for _, db := range dbs {
+		args = append(args, []string{"-d", db, word})
+	}
+	args = append(args, []string{"-m", word})
+
+	err := errors.New("no defs")
+	for _, a := range args {
+		out, cerr := exec.Command(p.dict, a...).Output()
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+		var res string
+		if res, err = parseOfflineOutput(string(out)); err == nil {
+			return res, nil
+		}
+	}
+	return "", err
+}
+
+// parseOfflineOutput turns raw dict output into the definition text: it drops
+// the banner/header lines and bracketed source tags, starts at the first line
+// that looks like a definition, and keeps at most 48 lines.
+func parseOfflineOutput(out string) (string, error) {
+	raw := strings.TrimSpace(out)
+	if raw == "" {
+		return "", errors.New("empty")
+	}
+	if strings.Contains(raw, "No definitions found for") || strings.Contains(raw, "perhaps you mean") {
+		return "", errors.New("no defs")
+	}
+
+	lines := strings.Split(raw, "\n")
+
+	clean := make([]string, 0, 48)
+	started := false
+	prevBlank := false
+
+	for _, ln := range lines {
+		trim := strings.TrimSpace(ln)
+
+		if strings.HasPrefix(ln, "From ") ||
+			strings.HasPrefix(ln, "Database") ||
+			strings.Contains(ln, "definition found") ||
+			strings.HasPrefix(ln, "Copyright") ||
+			strings.HasPrefix(ln, "dictd") ||
+			strings.HasPrefix(ln, "----") {
+			continue
+		}
+		if trim == "." {
+			continue
+		}
+		if dbHeaderLineRe.MatchString(trim) && len(clean) == 0 {
+			continue
+		}
+
+		if trim == "" {
+			if started && !prevBlank && len(clean) > 0 {
+				clean = append(clean, "")
+				prevBlank = true
+			}
+			continue
+		}
+
+		norm := normalizeOfflineLine(ln)
+		if norm == "" {
+			continue
+		}
+
+		if !started {
+			if strings.HasPrefix(norm, "1.") ||
+				strings.HasPrefix(norm, "2.") ||
+				strings.HasPrefix(norm, "The ") ||
+				strings.HasPrefix(norm, "A ") ||
+				strings.HasPrefix(norm, "An ") ||
+				wnSenseRe.MatchString(norm) {
+				started = true
+			} else {
+				continue
+			}
+		}
+
+		clean = append(clean, norm)
+		prevBlank = false
+		if len(clean) >= 48 {
+			break
+		}
+	}
+
+	outStr := strings.TrimSpace(strings.Join(clean, "\n"))
+	if outStr == "" {
+		return "", errors.New("no usable offline content")
+	}
+	return outStr, nil
+}
+
+// clampBody shortens s to about limit characters (runes, so multi-byte
+// text is never split) for the notification, leaving 80 for the "click to
+// open" note. It cuts after the last sentence when that keeps at least half
+// the text, else at the last whitespace, so no word is split.
+func clampBody(s string, limit int) string {
+	if limit < bodyMaxMin {
+		limit = bodyMaxChars // a zero config.bodyMax, from a config{} not built by loadConfig
+	}
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	head := string([]rune(s)[:limit-80])
+	if i := lastSentenceEnd(head); i >= len(head)/2 {
+		head = head[:i]
+	} else if i := strings.LastIndexFunc(head, unicode.IsSpace); i > 0 {
+		head = head[:i]
+	}
+	return strings.TrimSpace(head) + "\n\n… (click to open full)"
+}
+
+// lastSentenceEnd is the index just past the last ".", "!" or "?" in s that
+// is followed by whitespace, or -1.
+func lastSentenceEnd(s string) int {
+	for i := len(s) - 2; i >= 0; i-- {
+		if strings.IndexByte(".!?", s[i]) >= 0 && unicode.IsSpace(rune(s[i+1])) {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// markupEscaper escapes the characters that are special in the notification
+// body markup (a small subset of HTML).
+var markupEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// plainBody is a notificationBody as plain text, for --no-markup and for
+// servers without body-markup. Unlike stripHTML it keeps the layout; tags
+// go before entities, so an escaped "<" in a definition stays put.
+func plainBody(body string) string {
+	return html.UnescapeString(htmlTagRe.ReplaceAllString(body, ""))
+}
+
+// notificationBody is the bolded headword followed by the clamped
+// definition. Both are escaped so a "<" or "&" in a definition can't break
+// the markup; clamping happens first so an entity is never cut in half.
+func notificationBody(showWord, full string, limit int) string {
+	return "<b><i>" + markupEscaper.Replace(showWord) + "</i></b>\n" + markupEscaper.Replace(clampBody(full, limit))
+}
+
+func sourceEmoji(src string) string {
+	switch src {
+	case "mw":
+		return "📕"
+	case "online":
+		return "☁️"
+	case "wiktionary":
+		return "🧾"
+	case "offline":
+		return "🗄️"
+	case "custom":
+		return "📒"
+	case "unreachable":
+		return "⚠️"
+	default:
+		return "❓"
+	}
+}
+
+// sourceIcon is the notification icon: DEFINE_ICON (a themed icon name or
+// an image path) when set, else a themed icon per source, like sourceEmoji.
+func sourceIcon(src string) string {
+	if icon := strings.TrimSpace(os.Getenv("DEFINE_ICON")); icon != "" {
+		return icon
+	}
+	switch src {
+	case "custom", "mw", "online", "wiktionary":
+		return "accessories-dictionary"
+	case "offline":
+		return "drive-harddisk"
+	case "unreachable":
+		return "network-error"
+	default:
+		return "dialog-question"
+	}
+}
+
+// dictSource is one definition provider in the lookup chain.
+type dictSource interface {
+	name() string
+	online() bool  // network sources are raced and guarded by a breaker
+	enabled() bool // whether it can run for this lookup
+	lookup(ctx context.Context, word string) (text, audio string, err error)
+}
+
+// lookupEnv is what a source needs to know about the lookup it is part of.
+type lookupEnv struct {
+	cfg    config
+	client *http.Client
+	p      paths
+	lang   string
+}
+
+// customSource is the user's own glossary, custom.json.
+type customSource struct{ lookupEnv }
+
+func (customSource) name() string    { return "custom" }
+func (customSource) online() bool    { return false }
+func (s customSource) enabled() bool { return !s.cfg.forceOnline && customGlossary.size() > 0 }
+func (customSource) lookup(_ context.Context, word string) (string, string, error) {
+	text, err := lookupCustom(word)
+	return text, "", err
+}
+
+type mwSource struct{ lookupEnv }
+
+func (mwSource) name() string { return "mw" }
+func (mwSource) online() bool { return true }
+func (s mwSource) enabled() bool {
+	return !s.cfg.offlineOnly && s.lang == defaultLang && mwAPIKey() != ""
+}
+func (s mwSource) lookup(ctx context.Context, word string) (string, string, error) {
+	text, err := lookupMerriamWebster(ctx, s.client, word, s.cfg.pos, s.cfg.maxMeanings)
+	return text, "", err
+}
+
+// primarySource is dictionaryapi.dev, the only source with audio.
+type primarySource struct{ lookupEnv }
+
+func (primarySource) name() string    { return "online" }
+func (primarySource) online() bool    { return true }
+func (s primarySource) enabled() bool { return !s.cfg.offlineOnly }
+func (s primarySource) lookup(ctx context.Context, word string) (string, string, error) {
+	return lookupPrimary(ctx, s.client, s.lang, word, s.cfg.pos, s.cfg.maxMeanings, s.cfg.maxExamples)
+}
+
+type wiktionarySource struct{ lookupEnv }
+
+func (wiktionarySource) name() string    { return "wiktionary" }
+func (wiktionarySource) online() bool    { return true }
+func (s wiktionarySource) enabled() bool { return !s.cfg.offlineOnly }
+func (s wiktionarySource) lookup(ctx context.Context, word string) (string, string, error) {
+	text, used, err := lookupWiktionary(ctx, s.client, s.lang, word, s.cfg.pos, s.cfg.maxDefs, s.cfg.anyLang)
+	if err == nil && used != s.lang {
+		debugf(s.cfg, "wiktionary %q: no %s section, used %s", word, s.lang, used)
+	}
+	return text, "", err
+}
+
+type offlineSource struct{ lookupEnv }
+
+func (offlineSource) name() string    { return "offline" }
+func (offlineSource) online() bool    { return false }
+func (s offlineSource) enabled() bool { return !s.cfg.noOffline && !s.cfg.forceOnline }
+func (s offlineSource) lookup(_ context.Context, word string) (string, string, error) {
+	text, err := offlineLookup(s.p, word)
+	return text, "", err
+}
+
+// buildSources turns the configured order into the sources that can run
+// for this lookup.
+func buildSources(env lookupEnv) []dictSource {
+	order := env.cfg.sources
+	if order == nil {
+		order = defaultSources
+	}
+	var srcs []dictSource
+	for _, name := range order {
+		if mk := sourceRegistry[name]; mk != nil {
+			if s := mk(env); s.enabled() {
+				srcs = append(srcs, s)
+			}
+		}
+	}
+	return srcs
+}
+
+// lookupSource runs one source for one candidate, through its breaker if
+// it is an online one.
+func lookupSource(ctx context.Context, s dictSource, word string) (text, audio string, err error) {
+	if s.online() {
+		if !sourceBreakers.allow(s.name()) {
+			lookupMetrics.source(s.name(), "skipped", 0)
+			return "", "", errBreakerOpen
+		}
+		defer func() { sourceBreakers.record(s.name(), err) }()
+	}
+	start := time.Now()
+	defer func() { lookupMetrics.source(s.name(), sourceResult(ctx, text, err), time.Since(start)) }()
+	return s.lookup(ctx, word)
+}
+
+// sourceResult labels one source call for the metrics.
+func sourceResult(ctx context.Context, text string, err error) string {
+	switch {
+	case err == nil && text != "":
+		return "found"
+	case err == nil:
+		return "not_found"
+	case ctx.Err() != nil:
+		return "cancelled"
+	default:
+		return "error"
+	}
+}
+
+var errBreakerOpen = errors.New("skipped: source is failing")
+
+type breaker struct {
+	fails     int
+	first     time.Time // start of the current failure window
+	openUntil time.Time
+	probing   bool // half-open: one request is testing the source
+}
+
+// breakers keeps a circuit breaker per online source, so an outage costs a
+// few timeouts rather than one per lookup.
+type breakers struct {
+	mu  sync.Mutex
+	m   map[string]*breaker
+	now func() time.Time
+}
+
+func newBreakers() *breakers {
+	return &breakers{m: map[string]*breaker{}, now: time.Now}
+}
+
+// sourceBreakers lives as long as the process, so in the daemon the state
+// carries across lookups.
+var sourceBreakers = newBreakers()
+
+// allow reports whether src may be queried now. After the cool-down a
+// single probe is let through; its result closes or reopens the breaker.
+func (b *breakers) allow(src string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.m[src]
+	if br == nil || br.openUntil.IsZero() {
+		return true
+	}
+	if b.now().Before(br.openUntil) || br.probing {
+		return false
+	}
+	br.probing = true
+	return true
+}
+
+func (b *breakers) record(src string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.m[src]
+	if br == nil {
+		br = &breaker{}
+		b.m[src] = br
+	}
+	now := b.now()
+	if errors.Is(err, context.Canceled) {
+		// A cancelled race loser says nothing about the source; a probe
+		// that got cancelled just lets the next request probe instead.
+		br.probing = false
+		return
+	}
+	if !isOutage(err) {
+		*br = breaker{}
+		return
+	}
+	if br.probing {
+		br.probing = false
+		br.openUntil = now.Add(breakerCooldown)
+		return
+	}
+	if br.fails == 0 || now.Sub(br.first) > breakerWindow {
+		br.fails, br.first = 0, now
+	}
+	br.fails++
+	if br.fails >= breakerThreshold {
+		br.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the source latency
+// histogram. Anything slower lands in +Inf.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metrics counts how lookups were answered and how each source did, for the
+// daemon's --metrics-addr endpoint. Direct lookups update it too; nobody
+// reads it there.
+type metrics struct {
+	mu      sync.Mutex
+	lookups map[string]int64 // by how they were answered: memory, disk, fetch, shared
+	sources map[string]*sourceMetrics
+}
+
+type sourceMetrics struct {
+	results map[string]int64 // found, not_found, error, cancelled, skipped
+	buckets []int64          // per latencyBuckets entry, not cumulative
+	sum     time.Duration
+	count   int64
+}
+
+var lookupMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{lookups: map[string]int64{}, sources: map[string]*sourceMetrics{}}
+}
+
+func (m *metrics) lookup(how string) {
+	m.mu.Lock()
+	m.lookups[how]++
+	m.mu.Unlock()
+}
+
+// source records one call to src. took is zero for a call that never ran
+// (its breaker was open) and is then left out of the histogram.
+func (m *metrics) source(src, result string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.sources[src]
+	if sm == nil {
+		sm = &sourceMetrics{results: map[string]int64{}, buckets: make([]int64, len(latencyBuckets))}
+		m.sources[src] = sm
+	}
+	sm.results[result]++
+	if took <= 0 {
+		return
+	}
+	sm.sum += took
+	sm.count++
+	if i, _ := slices.BinarySearch(latencyBuckets, took.Seconds()); i < len(latencyBuckets) {
+		sm.buckets[i]++
+	}
+}
+
+// write renders m and the memory cache stats in the Prometheus text format.
+func (m *metrics) write(w io.Writer, mem lruStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP define_lookups_total Lookups by how they were answered.")
+	fmt.Fprintln(w, "# TYPE define_lookups_total counter")
+	for _, how := range slices.Sorted(maps.Keys(m.lookups)) {
+		fmt.Fprintf(w, "define_lookups_total{answer=%q} %d\n", how, m.lookups[how])
+	}
+
+	fmt.Fprintln(w, "# HELP define_source_requests_total Source calls by result.")
+	fmt.Fprintln(w, "# TYPE define_source_requests_total counter")
+	srcs := slices.Sorted(maps.Keys(m.sources))
+	for _, src := range srcs {
+		sm := m.sources[src]
+		for _, res := range slices.Sorted(maps.Keys(sm.results)) {
+			fmt.Fprintf(w, "define_source_requests_total{source=%q,result=%q} %d\n", src, res, sm.results[res])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP define_source_duration_seconds How long source calls took.")
+	fmt.Fprintln(w, "# TYPE define_source_duration_seconds histogram")
+	for _, src := range srcs {
+		sm := m.sources[src]
+		var cum int64
+		for i, le := range latencyBuckets {
+			cum += sm.buckets[i]
+			fmt.Fprintf(w, "define_source_duration_seconds_bucket{source=%q,le=\"%g\"} %d\n", src, le, cum)
+		}
+		fmt.Fprintf(w, "define_source_duration_seconds_bucket{source=%q,le=\"+Inf\"} %d\n", src, sm.count)
+		fmt.Fprintf(w, "define_source_duration_seconds_sum{source=%q} %g\n", src, sm.sum.Seconds())
+		fmt.Fprintf(w, "define_source_duration_seconds_count{source=%q} %d\n", src, sm.count)
+	}
+
+	fmt.Fprintln(w, "# HELP define_mem_cache_hits_total Memory cache hits.")
+	fmt.Fprintln(w, "# TYPE define_mem_cache_hits_total counter")
+	fmt.Fprintf(w, "define_mem_cache_hits_total %d\n", mem.Hits)
+	fmt.Fprintln(w, "# HELP define_mem_cache_misses_total Memory cache misses.")
+	fmt.Fprintln(w, "# TYPE define_mem_cache_misses_total counter")
+	fmt.Fprintf(w, "define_mem_cache_misses_total %d\n", mem.Misses)
+	fmt.Fprintln(w, "# HELP define_mem_cache_evictions_total Memory cache entries dropped for capacity.")
+	fmt.Fprintln(w, "# TYPE define_mem_cache_evictions_total counter")
+	fmt.Fprintf(w, "define_mem_cache_evictions_total %d\n", mem.Evictions)
+	fmt.Fprintln(w, "# HELP define_mem_cache_entries Entries in the memory cache.")
+	fmt.Fprintln(w, "# TYPE define_mem_cache_entries gauge")
+	fmt.Fprintf(w, "define_mem_cache_entries %d\n", mem.Size)
+}
+
+// metricsListenAddr turns a --metrics-addr value into a loopback host:port.
+// A bare port or ":port" binds 127.0.0.1; other hosts are refused, since the
+// endpoint is only meant to be scraped from the same machine.
+func metricsListenAddr(v string) (string, error) {
+	if !strings.Contains(v, ":") {
+		v = ":" + v
+	}
+	host, port, err := net.SplitHostPort(v)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("port %q out of range", port)
+	}
+	switch {
+	case host == "" || host == "localhost":
+		host = "127.0.0.1"
+	case net.ParseIP(host) == nil || !net.ParseIP(host).IsLoopback():
+		return "", fmt.Errorf("%s is not a loopback address", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveMetrics starts the /metrics listener on addr in the background.
+func serveMetrics(addr string, mem *lruCache) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		lookupMetrics.write(w, mem.stats())
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	return srv, nil
+}
+
+type raceResult struct {
+	rank                   int // position in the source order; lower is preferred
+	src, text, audio, used string
+	fail                   error // when text is empty, as from lookupFirst
+}
+
+// raceOnline queries the enabled online sources concurrently and returns the
+// most preferred success. Once any source succeeds, more preferred sources
+// still running get raceGrace to beat it; everything left is then cancelled.
+// An empty text means every online source failed; fail is then as for
+// lookupFirst, nil if any of them said it had no definition.
+func raceOnline(ctx context.Context, cfg config, sources []dictSource, word string) (text, used, source, audio string, fail error) {
+	var srcs []dictSource
+	for _, s := range sources {
+		if s.online() {
+			srcs = append(srcs, s)
+		}
+	}
+	if len(srcs) == 0 {
+		return "", "", "none", "", nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(srcs))
+	for i, src := range srcs {
+		go func() {
+			o, a, used, fail := lookupFirst(ctx, cfg, src, word)
+			if o != "" {
+				results <- raceResult{rank: i, src: src.name(), text: o, audio: a, used: used}
+				return
+			}
+			results <- raceResult{rank: i, fail: fail}
+		}()
+	}
+
+	done := make([]bool, len(srcs))
+	var best *raceResult
+	var out outage
+	var grace <-chan time.Time
+	for pending := len(srcs); pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			done[r.rank] = true
+			if r.text == "" {
+				out.add(r.fail)
+			}
+			if r.text != "" && (best == nil || r.rank < best.rank) {
+				best = &r
+			}
+		case <-grace:
+			pending = 0
+			continue
+		}
+		if best == nil {
+			continue
+		}
+		if !slices.Contains(done[:best.rank], false) {
+			break // nothing more preferred is still running
+		}
+		if grace == nil {
+			grace = time.After(raceGrace)
+		}
+	}
+	if best == nil {
+		return "", "", "none", "", out.err()
+	}
+	return best.text, best.used, best.src, best.audio, nil
+}
+
+// lookupFirst asks src for word's candidates and returns the answer for the
+// earliest one that has any. An online source gets all candidates at once
+// (unless --sequential), so a word that only matches its third candidate
+// costs one round trip rather than three; once the earliest answer is known
+// the rest are cancelled. With no answer, fail is why when src couldn't be
+// reached for any candidate, and nil when it said it had no definition.
+func lookupFirst(ctx context.Context, cfg config, src dictSource, word string) (text, audio, used string, fail error) {
+	cands := lookupCandidates(cfg, word)
+	var out outage
+	if !src.online() || cfg.sequential || len(cands) == 1 {
+		for _, cand := range cands {
+			o, a, err := lookupSource(ctx, src, cand.word)
+			if err == nil && o != "" {
+				return o, a, cand.word, nil
+			}
+			debugf(cfg, "%s %q: %v", src.name(), cand.word, err)
+			out.add(err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return "", "", "", out.err()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout())
+	defer cancel()
+	type answer struct {
+		text, audio string
+		err         error
+	}
+	answers := make([]chan answer, len(cands))
+	for i, cand := range cands {
+		answers[i] = make(chan answer, 1)
+		go func() {
+			o, a, err := lookupSource(ctx, src, cand.word)
+			answers[i] <- answer{o, a, err}
+		}()
+	}
+	for i, cand := range cands {
+		a := <-answers[i]
+		if a.err == nil && a.text != "" {
+			return a.text, a.audio, cand.word, nil
+		}
+		debugf(cfg, "%s %q: %v", src.name(), cand.word, a.err)
+		out.add(a.err)
+	}
+	return "", "", "", out.err()
+}
+
+// outage tells a lookup that found nothing because the sources couldn't be
+// reached (timeouts, network errors, 429/5xx, an open breaker) from one
+// where they answered that there is no such word.
+type outage struct {
+	answered bool  // some source got to say it had no definition
+	last     error // the most recent failure
+	timedOut bool
+}
+
+// add records the error of one source call with no definition.
+func (o *outage) add(err error) {
+	if err == nil || !(isOutage(err) || errors.Is(err, errBreakerOpen)) {
+		o.answered = true
+		return
+	}
+	o.last = err
+	o.timedOut = o.timedOut || isTimeout(err)
+}
+
+// err is the failure to report: nil unless every call failed to get through.
+func (o outage) err() error {
+	if o.answered || o.last == nil {
+		return nil
+	}
+	if o.timedOut {
+		return fmt.Errorf("timed out: %w", o.last)
+	}
+	return o.last
+}
+
+// isTimeout reports whether err is a deadline or network timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// diskEntryTTL is how long a disk cache entry from source stays fresh.
+func diskEntryTTL(source string) time.Duration {
+	switch source {
+	case "offline":
+		return offlineRefresh()
+	case "none":
+		return negativeTTL
+	}
+	return cacheLifetime()
+}
+
+// expired reports whether de is past its diskEntryTTL at now.
+func expired(de diskEntry, now time.Time) bool {
+	return now.Sub(de.TS) > diskEntryTTL(de.Source)
+}
+
+// lookupKey is the language a lookup runs in and its cache key.
+func lookupKey(cfg config, word string) (lang, key string) {
+	lang = cfg.lang
+	if lang == "" {
+		lang = defaultLang
+	}
+	key = cacheKey(lang, word)
+	if cfg.pos != "" {
+		key += "#" + cfg.pos // filtered results are cached apart from the full entry
+	}
+	if cfg.allSources {
+		key += "+all"
+	}
+	if cfg.offlineOnly {
+		key += "+offline" // an offline miss mustn't hide the online answer later
+	}
+	if cfg.stem {
+		key += "+stem" // may answer from the Porter stem, which a plain lookup doesn't try
+	}
+	if cfg.anyLang {
+		key += "+anylang" // may answer from another language's section
+	}
+	if cfg.noThesaurus {
+		key += "+nothes" // the cached text would otherwise carry the synonyms
+	}
+	if cfg.noEtymology {
+		key += "+noety" // likewise the etymology in the full view
+	}
+	return lang, key
+}
+
+// resolveDefinition answers from the caches or fetches word. Cancelling ctx
+// aborts the fetch; its result is then returned but not cached.
+func resolveDefinition(ctx context.Context, cfg config, p paths, mem *lruCache, disk *diskCache, word string, client *http.Client) (de diskEntry) {
+	defer func() {
+		switch {
+		case ctx.Err() != nil, de.Source == "unreachable":
+		case de.Source == "none":
+			recordMiss(word)
+		default:
+			appendHistory(word, de.Source)
+		}
+	}()
+
+	lang, key := lookupKey(cfg, word)
+
+	// --force-online skips both cache layers (and the offline source below)
+	// so the answer really comes from the network; it is still cached. A
+	// glossary entry is never cached, and beats whatever was cached before
+	// it was added.
+	if !cfg.forceOnline && !inGlossary(cfg, word) {
+		if de, ok := mem.get(key); ok {
+			debugf(cfg, "cache hit (memory) %q: %s", key, de.Source)
+			lookupMetrics.lookup("memory")
+			return de
+		}
+
+		if de, ok := disk.fresh(key); ok {
+			debugf(cfg, "cache hit (disk) %q: %s", key, de.Source)
+			lookupMetrics.lookup("disk")
+			mem.set(key, de)
+			return de
+		}
+		debugf(cfg, "cache miss %q", key)
+	}
+
+	// Concurrent misses for the same key share one fetch, under the first
+	// caller's ctx. Once it finishes the result is cached, so a later lookup
+	// is a cache hit rather than being coalesced or dropped.
+	v, _, shared := fetchGroup.Do(key, func() (any, error) {
+		old, hadOld := disk.get(key) // expired, or skipped by --force-online
+		de := fetchDefinition(ctx, cfg, p, client, lang, word)
+		if ctx.Err() != nil {
+			return de, nil // cut short; caching it would pin a bogus miss
+		}
+		if de.Source == "custom" {
+			return de, nil // re-read every time, so edits to custom.json show at once
+		}
+		if de.Source == "unreachable" {
+			return de, nil // the next lookup should try the network again
+		}
+		mem.set(key, de)
+		disk.set(key, de)
+		// Only the returned copy is marked, so the next cache hit reads
+		// normally again.
+		if hadOld && old.Source != "none" && de.Source != "none" && old.Full != de.Full {
+			debugf(cfg, "definition of %q changed since %s:\n%s", key, old.TS.Format(time.DateTime), strings.Join(lineDiff(old.Full, de.Full), "\n"))
+			de.Title += " (updated)"
+		}
+		return de, nil
+	})
+	if shared {
+		debugf(cfg, "shared in-flight fetch for %q", key)
+		lookupMetrics.lookup("shared")
+	} else {
+		lookupMetrics.lookup("fetch")
+	}
+	return v.(diskEntry)
+}
+
+// fetchGroup coalesces concurrent fetches of the same cache key.
+var fetchGroup singleflight.Group
+
+// lineDiff compares a and b line by line and returns the lines only in a
+// prefixed with "- " and those only in b with "+ ", in order. Definitions
+// are a few dozen lines, so the quadratic LCS table is fine.
+func lineDiff(a, b string) []string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// lcs[i][j] is the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+x[i])
+			i++
+		default:
+			out = append(out, "+ "+y[j])
+			j++
+		}
+	}
+	return out
+}
+
+type sourceText struct {
+	src, text string
+}
+
+// fetchDefinition queries the sources for word and builds the entry to
+// cache. It touches no shared state besides last.txt.
+func fetchDefinition(ctx context.Context, cfg config, p paths, client *http.Client, lang, word string) diskEntry {
+	start := time.Now()
+
+	// The daemon's pool is usually warm already. A direct lookup starts
+	// cold, so connect to the Datamuse and Wiktionary hosts while the main
+	// source is being queried.
+	if cfg.warmUp && lang == defaultLang && !cfg.offlineOnly {
+		var hosts []string
+		if !cfg.noThesaurus {
+			hosts = append(hosts, apiHost(datamuseAPI))
+		}
+		if !cfg.noEtymology {
+			hosts = append(hosts, apiHost(extractAPI))
+		}
+		warmUp(client, hosts...)
+	}
+
+	var out, used, audio string
+	source := "none"
+
+	srcs := buildSources(lookupEnv{cfg: cfg, client: client, p: p, lang: lang})
+	// --all-sources asks every source anyway, so there is nothing to race.
+	race := cfg.race && !cfg.allSources
+	// Only the online sources say whether the network is the problem; an
+	// offline or glossary miss alongside them still reads as a timeout.
+	var down outage
+	if race {
+		var fail error
+		out, used, source, audio, fail = raceOnline(ctx, cfg, srcs, word)
+		if out == "" && slices.ContainsFunc(srcs, dictSource.online) {
+			down.add(fail)
+		}
+	}
+	var others []sourceText // --all-sources: answers after the first
+	for _, src := range srcs {
+		if out != "" && !cfg.allSources {
+			break
+		}
+		if race && src.online() {
+			continue
+		}
+		switch o, a, u, fail := lookupFirst(ctx, cfg, src, word); {
+		case o == "":
+			if src.online() {
+				down.add(fail)
+			}
+		case out == "":
+			out, used, source, audio = o, u, src.name(), a
+		default:
+			others = append(others, sourceText{src.name(), o})
+		}
+	}
+
+	// Datamuse and the etymology extract are English-only and online; an
+	// offline answer usually means the network is down anyway. Both run at
+	// once so the extras cost one short timeout, not two.
+	extras := out != "" && lang == defaultLang && source != "offline" && source != "custom"
+	var ety string
+	etyDone := make(chan struct{})
+	if extras && !cfg.noEtymology {
+		go func() {
+			defer close(etyDone)
+			ety = lookupEtymology(ctx, client, used)
+		}()
+	} else {
+		close(etyDone)
+	}
+	if extras && !cfg.noThesaurus {
+		if th := lookupThesaurus(ctx, client, used); th != "" {
+			out += "\n\n" + th
+		}
+	}
+	<-etyDone
+
+	if fail := down.err(); out == "" && fail != nil && ctx.Err() == nil {
+		debugf(cfg, "%q: no source reachable: %v", word, fail)
+		out, used, source = "⚠️ Couldn't reach the dictionaries — try again.", word, "unreachable"
+		if down.timedOut {
+			out = "⚠️ Network timeout — try again."
+		}
+	}
+	if out == "" {
+		out, used, source = "No definition found.", word, "none"
+		if lang == defaultLang && !cfg.offlineOnly {
+			if sugg := lookupSuggestions(ctx, client, word); len(sugg) > 0 {
+				out += "\n\nDid you mean: " + strings.Join(sugg, ", ") + "?"
+			}
+		}
+	}
+	debugf(cfg, "resolved %q via %s (lemma %q) in %s", word, source, used, time.Since(start).Round(time.Millisecond))
+
+	showWord := cap1(word)
+	if used != "" && strings.ToLower(word) != used {
+		showWord = cap1(word) + " → " + cap1(used)
+	}
+
+	// The other sources and the etymology are only for the full view; the
+	// notification stays short.
+	short := strings.TrimSpace(out)
+	full := short
+	if len(others) > 0 {
+		full = "— " + source + " —\n" + short
+		for _, o := range others {
+			full += "\n\n— " + o.src + " —\n" + strings.TrimSpace(o.text)
+		}
+	}
+	if ety != "" {
+		full += "\n\nEtymology:\n" + ety
+	}
+	if note := inflectionNote(word, used); note != "" {
+		short = note + "\n\n" + short
+		full = note + "\n\n" + full
+	}
+	de := diskEntry{
+		Title:  formatTitle(cfg.titleFormat, word, used, source),
+		Body:   notificationBody(showWord, short, cfg.bodyMax),
+		Full:   full,
+		TS:     time.Now(),
+		Source: source,
+		Lemma:  used,
+		Audio:  audio,
+	}
+	writeLast(word, de)
+	return de
+}
+
+// titleFormatDefault is the notification title unless DEFINE_TITLE_FORMAT
+// or title_format says otherwise.
+const titleFormatDefault = "📘 {word} {emoji}"
+
+// formatTitle fills in a title format: {word} is the word as looked up,
+// {lemma} the form that matched, {source} the source's name and {emoji} its
+// emoji. Anything else in braces is kept as typed.
+func formatTitle(format, word, lemma, source string) string {
+	if lemma == "" {
+		lemma = word
+	}
+	return strings.TrimSpace(strings.NewReplacer(
+		"{word}", cap1(word),
+		"{lemma}", cap1(lemma),
+		"{source}", source,
+		"{emoji}", sourceEmoji(source),
+	).Replace(cmp.Or(format, titleFormatDefault)))
+}
+
+// lookupSlots is a counting semaphore bounding concurrent lookups.
+type lookupSlots chan struct{}
+
+func newLookupSlots(n int) lookupSlots { return make(lookupSlots, n) }
+
+// acquire takes a slot, waiting up to wait for one to free up. It reports
+// false if none did; the caller then drops the request.
+func (s lookupSlots) acquire(wait time.Duration) bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (s lookupSlots) release() { <-s }
+
+// run calls fn holding a slot. A request that finds none free within wait
+// is dropped: run returns false without calling fn.
+func (s lookupSlots) run(wait time.Duration, fn func()) bool {
+	if !s.acquire(wait) {
+		return false
+	}
+	defer s.release()
+	fn()
+	return true
+}
+
+// deduper drops a word repeated within its window, and remembers the last
+// notification shown so that a repeat after the window replaces it instead
+// of stacking a second one.
+type deduper struct {
+	mu        sync.Mutex
+	window    time.Duration
+	last      map[string]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+
+	shownKey  string
+	shownID   uint32
+	shownStop chan struct{} // ends the click handler of shownID
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{window: window, last: map[string]time.Time{}, now: time.Now}
+}
+
+// allow reports whether key may be looked up now. Every dedupePruneEvery it
+// also forgets keys not seen for a few windows, so a long-running daemon
+// doesn't keep every word it was ever asked for.
+func (d *deduper) allow(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	if d.lastPrune.IsZero() {
+		d.lastPrune = now
+	}
+	if now.Sub(d.lastPrune) >= dedupePruneEvery {
+		for k, t := range d.last {
+			if now.Sub(t) >= 4*d.window {
+				delete(d.last, k)
+			}
+		}
+		d.lastPrune = now
+	}
+	if t, ok := d.last[key]; ok && now.Sub(t) < d.window {
+		return false
+	}
+	d.last[key] = now
+	return true
+}
+
+// replace is called before showing key. When key is the word shown last, it
+// returns that notification's id for replaces_id and stops its click
+// handler; the returned channel stops the handler of the new one.
+func (d *deduper) replace(key string) (id uint32, stop chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key == d.shownKey && d.shownID != 0 {
+		id = d.shownID
+		close(d.shownStop)
+	}
+	d.shownKey, d.shownID, d.shownStop = key, 0, make(chan struct{})
+	return id, d.shownStop
+}
+
+// shown records the id the server gave key's notification.
+func (d *deduper) shown(key string, id uint32, stop chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.shownKey == key && d.shownStop == stop {
+		d.shownID = id
+	}
+}
+
+// soundName is the freedesktop sound theme name for a lookup's result, or
+// "" when --sound is off.
+func soundName(cfg config, source string) string {
+	switch {
+	case !cfg.sound:
+		return ""
+	case source == "none", source == "unreachable":
+		return cfg.soundNone
+	}
+	return cfg.soundFound
+}
+
+func notifyDBusAndHandleClick(cfg config, p paths, word string, de diskEntry) {
+	notify(cfg, p, word, de, 0, nil, nil)
+}
+
+// notify shows de, the definition of word, replacing notification replaces
+// when it is not 0, and handles its actions until it is clicked, times out
+// or stop is closed. It returns the notification's id, or 0 when none could
+// be shown. When the sources couldn't be reached, a non-nil retry adds a
+// Retry action that looks the word up again and shows the result in place.
+// An empty word is a notice rather than a lookup, and isn't recorded.
+func notify(cfg config, p paths, word string, de diskEntry, replaces uint32, stop <-chan struct{}, retry func() diskEntry) uint32 {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		debugf(cfg, "no session bus: %v", err)
+		printFallback(cfg, de)
+		return 0
+	}
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+
+	body, actions, hints := notifyArgs(cfg, p, de, serverCaps(obj), retry != nil)
+	var id uint32
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		appName, replaces, sourceIcon(de.Source), de.Title, body, actions, hints, int32(cfg.expire/time.Millisecond),
+	)
+	if call.Err != nil {
+		debugf(cfg, "notify: %v", call.Err)
+		printFallback(cfg, de)
+		return 0
+	}
+	_ = call.Store(&id)
+	if len(actions) == 0 {
+		// Nothing to click. A cache hit doesn't touch last.txt, so write it
+		// here for --full to open instead.
+		if word != "" {
+			writeLast(word, de)
+		}
+		return id
+	}
+
+	c := make(chan *dbus.Signal, 8)
+	conn.Signal(c)
+	_ = conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.Notifications"),
+		dbus.WithMatchMember("ActionInvoked"),
+	)
+
+	go func() {
+		defer conn.RemoveSignal(c)
+
+		wait := 10 * time.Minute
+		if cfg.expire > 0 {
+			wait = min(wait, cfg.expire)
+		}
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+
+		for {
+			select {
+			case sig := <-c:
+				if sig == nil || len(sig.Body) < 2 {
+					continue
+				}
+				nid, ok := sig.Body[0].(uint32)
+				if !ok || nid != id {
+					continue
+				}
+				action, _ := sig.Body[1].(string)
+				switch action {
+				case "default", "full":
+					openFullText(p, de.Full)
+					return
+				case "audio":
+					go playAudio(p, de.Audio)
+				case "copy":
+					go copyToClipboard(p, de.Full)
+				case "retry":
+					go notify(cfg, p, word, retry(), id, stop, retry)
+					return
+				case "search":
+					openInBrowser(p, wiktionaryPage(de.Lemma))
+					return
+				case "browser":
+					openInBrowser(p, entryPage(cfg.lang, de))
+					return
+				}
+			case <-timeout.C:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return id
+}
+
+// notifyArgs builds the Notify call's body, actions and hints for de,
+// leaving out what the server's capabilities say it can't do: minimal
+// servers show markup tags literally and drop or mangle notifications
+// with actions or hints they don't know.
+func notifyArgs(cfg config, p paths, de diskEntry, caps map[string]bool, retry bool) (body string, actions []string, hints map[string]dbus.Variant) {
+	// The body is built as markup; the title is plain text per the spec.
+	body = de.Body
+	if cfg.noMarkup || !caps["body-markup"] {
+		body = plainBody(body)
+	}
+
+	if caps["actions"] {
+		actions = []string{
+			"default", "Open full",
+			"full", "Open full",
+		}
+		if de.Audio != "" && p.player != "" {
+			actions = append(actions, "audio", "Play audio")
+		}
+		if copyCommand(sessionType(), p) != nil {
+			actions = append(actions, "copy", "Copy")
+		}
+		switch {
+		case de.Source == "unreachable" && retry:
+			actions = append(actions, "retry", "Retry")
+		case de.Lemma == "" || p.xdgOpen == "":
+		case de.Source == "none":
+			actions = append(actions, "search", "Search Wiktionary")
+		case de.Source != "custom": // a glossary word may not be online at all
+			actions = append(actions, "browser", "Open in browser")
+		}
+	}
+
+	hints = map[string]dbus.Variant{}
+	// resident keeps the notification up after an action is invoked. It
+	// would outlive its expire_timeout on servers that honor the hint, so
+	// only ask for it when it never expires.
+	if len(actions) > 0 && cfg.expire == 0 {
+		hints["resident"] = dbus.MakeVariant(true)
+	}
+	if caps["persistence"] {
+		hints["transient"] = dbus.MakeVariant(false)
+	}
+	if name := soundName(cfg, de.Source); name != "" && caps["sound"] {
+		hints["sound-name"] = dbus.MakeVariant(name)
+	}
+	return body, actions, hints
+}
+
+// notifyCaps caches the notification server's capabilities: they are
+// asked once per process, so the daemon doesn't ask before every popup.
+var notifyCaps struct {
+	once sync.Once
+	caps map[string]bool
+}
+
+// serverCaps is the server's GetCapabilities answer. A server that doesn't
+// answer is assumed to support everything notify uses, as before it asked.
+func serverCaps(obj dbus.BusObject) map[string]bool {
+	notifyCaps.once.Do(func() {
+		var list []string
+		if err := obj.Call("org.freedesktop.Notifications.GetCapabilities", 0).Store(&list); err != nil {
+			list = []string{"actions", "body", "body-markup", "persistence", "sound"}
+		}
+		notifyCaps.caps = make(map[string]bool, len(list))
+		for _, c := range list {
+			notifyCaps.caps[c] = true
+		}
+	})
+	return notifyCaps.caps
+}
+
+// dndActive reports whether the desktop is in do-not-disturb mode. The
+// notification spec's Inhibited property (KDE Plasma) is asked first; dunst,
+// mako and SwayNotificationCenter only tell through their own CLIs, and
+// GNOME through its settings. A server nothing can be learnt from counts as
+// not in do-not-disturb.
+func dndActive(p paths) bool {
+	if conn, err := dbus.SessionBus(); err == nil {
+		obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+		if v, err := obj.GetProperty("org.freedesktop.Notifications.Inhibited"); err == nil {
+			if b, ok := v.Value().(bool); ok {
+				return b
+			}
+		}
+	}
+	for _, probe := range dndProbes(p) {
+		if out, err := runCmdCapture(probe[0], probe[1:]...); err == nil {
+			return dndFromOutput(filepath.Base(probe[0]), out)
+		}
+	}
+	return false
+}
+
+// dndProbes are the commands that report do-not-disturb state, for the
+// tools that are installed. The first that succeeds is believed; the others
+// fail when their daemon isn't the one running.
+func dndProbes(p paths) [][]string {
+	var probes [][]string
+	if p.dunstctl != "" {
+		probes = append(probes, []string{p.dunstctl, "is-paused"})
+	}
+	if p.makoctl != "" {
+		probes = append(probes, []string{p.makoctl, "mode"})
+	}
+	if p.swaync != "" {
+		probes = append(probes, []string{p.swaync, "--get-dnd"})
+	}
+	if p.gsettings != "" && strings.Contains(strings.ToUpper(os.Getenv("XDG_CURRENT_DESKTOP")), "GNOME") {
+		probes = append(probes, []string{p.gsettings, "get", "org.gnome.desktop.notifications", "show-banners"})
+	}
+	return probes
+}
+
+// dndFromOutput reads a probe's answer.
+func dndFromOutput(tool, out string) bool {
+	switch tool {
+	case "makoctl":
+		return slices.Contains(strings.Fields(out), "do-not-disturb")
+	case "gsettings":
+		return out == "false" // banners off
+	}
+	return out == "true" // dunstctl is-paused, swaync-client --get-dnd
+}
+
+// dndQueue holds the notifications held back while in do-not-disturb with
+// dnd = "queue", keeping the newest dndQueueMax.
+type dndQueue struct {
+	mu    sync.Mutex
+	items []queuedNotification
+}
+
+type queuedNotification struct {
+	cfg  config
+	word string
+	de   diskEntry
+}
+
+func (q *dndQueue) push(cfg config, word string, de diskEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, queuedNotification{cfg, word, de})
+	if len(q.items) > dndQueueMax {
+		q.items = q.items[len(q.items)-dndQueueMax:]
+	}
+}
+
+// take empties the queue and returns what was in it, oldest first.
+func (q *dndQueue) take() []queuedNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+func (q *dndQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// wiktionaryPage is the English Wiktionary page for word, the place to look
+// further for a word no source had.
+func wiktionaryPage(word string) string {
+	return "https://en.wiktionary.org/wiki/" + url.PathEscape(strings.ReplaceAll(word, " ", "_"))
+}
+
+// entryPage is the web page for a found entry's lemma: dictionary.com for
+// English, Wiktionary for other languages and for words only Wiktionary
+// had.
+func entryPage(lang string, de diskEntry) string {
+	if cmp.Or(lang, defaultLang) != defaultLang || de.Source == "wiktionary" {
+		return wiktionaryPage(de.Lemma)
+	}
+	return "https://www.dictionary.com/browse/" + url.PathEscape(de.Lemma)
+}
+
+// openInBrowser opens u with xdg-open, without waiting for the browser.
+func openInBrowser(p paths, u string) {
+	if p.xdgOpen == "" {
+		return
+	}
+	cmd := exec.Command(p.xdgOpen, u)
+	if cmd.Start() == nil {
+		go func() { _ = cmd.Wait() }()
+	}
+}
+
+// printFallback writes the entry to stdout when it can't be shown as a
+// notification (headless or SSH sessions). The daemon's stdout is a log, and
+// --json/--quiet have their own output, so those stay silent.
+func printFallback(cfg config, de diskEntry) {
+	if cfg.daemon || cfg.json || cfg.quiet {
+		return
+	}
+	fmt.Println(de.Title)
+	fmt.Println(de.Full)
+}
+
+// playAudio downloads a pronunciation recording and plays it with whichever
+// player resolvePaths found. Failures are silent, like the other actions.
+func playAudio(p paths, audioURL string) {
+	if p.player == "" || audioURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, audioURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", httpUserAgent())
+	resp, err := newHTTPClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+
+	ext := ".mp3"
+	if u, err := url.Parse(audioURL); err == nil && filepath.Ext(u.Path) != "" {
+		ext = filepath.Ext(u.Path)
+	}
+	f, err := os.CreateTemp("", "define-*"+ext)
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	var args []string
+	switch filepath.Base(p.player) {
+	case "mpv":
+		args = []string{"--no-video", "--really-quiet", f.Name()}
+	case "ffplay":
+		args = []string{"-nodisp", "-autoexit", "-loglevel", "quiet", f.Name()}
+	default:
+		args = []string{f.Name()}
+	}
+	_ = exec.Command(p.player, args...).Run()
+}
+
+// openFullText shows full in the first viewer that works: a GUI text box,
+// the pager when stdout is a terminal, the pager in an xterm, and finally
+// plain stdout.
+func openFullText(p paths, full string) {
+	tty := isTerminal(os.Stdout)
+	if f, err := os.CreateTemp("", "define-*.txt"); err == nil {
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(full + "\n")
+		if f.Close() == nil && err == nil {
+			// Closing a viewer can exit non-zero (zenity does), so only a
+			// viewer that fails to start falls through to the next option.
+			if c := viewerCommand(p, pagerCommand(), f.Name(), tty); c != nil {
+				if cmd := exec.Command(c[0], c[1:]...); cmd.Start() == nil {
+					_ = cmd.Wait()
+					return
+				}
+			}
+		}
+	}
+	if tty {
+		if pager := pagerCommand(); pager != nil {
+			cmd := exec.Command(pager[0], pager[1:]...)
+			cmd.Stdin = strings.NewReader(full + "\n")
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if cmd.Run() == nil {
+				return
+			}
+		}
+	}
+	fmt.Println(full)
+}
+
+// viewerCommand is the command that opens file for reading, or nil. Without
+// a GUI viewer, a terminal gets the pager directly, so xterm is only used
+// when there is none.
+func viewerCommand(p paths, pager []string, file string, tty bool) []string {
+	switch {
+	case p.zenity != "":
+		return []string{p.zenity, "--text-info", "--width=760", "--height=560", "--title=define", "--no-markup", "--filename=" + file}
+	case p.kdialog != "":
+		return []string{p.kdialog, "--title", "define", "--textbox", file, "760", "560"}
+	case p.yad != "":
+		return []string{p.yad, "--text-info", "--width=760", "--height=560", "--title=define", "--filename=" + file}
+	case !tty && p.xterm != "" && pager != nil:
+		return slices.Concat([]string{p.xterm, "-T", "define", "-e"}, pager, []string{file})
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// pagerCommand is $PAGER (split on spaces, so "less -R" works) or less -R,
+// or nil when neither is available.
+func pagerCommand() []string {
+	if args := strings.Fields(os.Getenv("PAGER")); len(args) > 0 {
+		if _, err := exec.LookPath(args[0]); err == nil {
+			return args
+		}
+	}
+	if p, err := exec.LookPath("less"); err == nil {
+		return []string{p, "-R"}
+	}
+	return nil
+}
+
+func openFullFromLast(p paths) {
+	ll, ok := readLast()
+	if !ok {
+		return
+	}
+	openFullText(p, ll.Full)
+}
+
+// showLast re-fires the notification for the last lookup.
+func showLast(cfg config, p paths) int {
+	ll, ok := readLast()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "define: no previous lookup")
+		return 1
+	}
+	notifyDBusAndHandleClick(cfg, p, ll.Word, lastEntry(cfg, ll))
+	return 0
+}
+
+// lastEntry rebuilds the notification for ll. A plain-text last.txt from an
+// older release has no title or body; the cached entry is used when the
+// newest history word's full text matches, else they are synthesized.
+func lastEntry(cfg config, ll lastLookup) diskEntry {
+	if ll.Title != "" && ll.Body != "" {
+		return diskEntry{Title: ll.Title, Body: ll.Body, Full: ll.Full, TS: time.Now(), Source: ll.Source}
+	}
+	show := "Last definition"
+	if ll.Word != "" {
+		show = cap1(ll.Word)
+	} else if hist := loadHistory(historyFilePath()); len(hist) > 0 {
+		if de, ok := loadDiskCache(cacheFilePath())[cacheKey(cfg.lang, hist[len(hist)-1].Word)]; ok && de.Full == ll.Full {
+			return de
+		}
+	}
+	return diskEntry{
+		Title:  formatTitle(cfg.titleFormat, show, "", ll.Source),
+		Body:   notificationBody(show, ll.Full, cfg.bodyMax),
+		Full:   ll.Full,
+		TS:     time.Now(),
+		Source: ll.Source,
+	}
+}
+
+func runDaemon(cfg config, p paths) int {
+	ln, sock, err := listenSocket()
+	if errors.Is(err, errDaemonRunning) {
+		debugf(cfg, "listen %s: %v", sock, err)
+		return 0 // someone beat us to it; clients will use that one
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "listen:", err)
+		return 1
+	}
+	defer ln.Close()
+	_ = os.Chmod(sock, 0o600)
+
+	mem := newLRU(memCacheMax, cacheLifetime())
+
+	client := newHTTPClient()
+
+	disk := openDiskCache(cacheFilePath())
+
+	debugf(cfg, "compact: pruned %d expired disk entries", disk.compact())
+
+	go func() {
+		t := time.NewTicker(2 * time.Second)
+		defer t.Stop()
+		lastCompact := time.Now()
+		for range t.C {
+			if time.Since(lastCompact) >= compactEvery {
+				debugf(cfg, "compact: pruned %d expired disk entries", disk.compact())
+				lastCompact = time.Now()
+			}
+			disk.flush()
+		}
+	}()
+
+	ded := newDeduper(repeatWindow())
+	var held dndQueue
+	slots := newLookupSlots(maxLookups())
 
-func sourceEmoji(src string) string {
-	switch src {
-	case "online":
-		return "☁️"
-	case "wiktionary":
-		return "🧾"
-	case "offline":
-		return "🗄️"
-	default:
-		return "❓"
+	if cfg.metricsAddr != "" {
+		srv, err := serveMetrics(cfg.metricsAddr, mem)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "metrics:", err)
+		} else {
+			debugf(cfg, "metrics: serving on http://%s/metrics", cfg.metricsAddr)
+			defer srv.Close()
+		}
 	}
-}
 
-func resolveDefinition(cfg config, p paths, mem *lruCache, disk map[string]diskEntry, diskDirty *bool, word string, client *http.Client) (title, body, full, source string) {
-	key := strings.ToLower(word)
+	started := time.Now()
+	var served atomic.Int64
+
+	// ctx ends with the daemon, aborting lookups still in flight. Clients
+	// hang up as soon as they have sent a request, so a closed connection
+	// is no reason to stop.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if it, ok := mem.get(key); ok {
-		return it.title, it.body, it.full, it.src
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var inflight sync.WaitGroup
+	shutdown := func() {
+		stopOnce.Do(func() {
+			cancel()
+			close(stop)
+			_ = ln.Close()
+		})
 	}
 
-	if de, ok := disk[key]; ok {
-		if de.Source == "offline" && time.Since(de.TS) > offlineRefreshAfter {
-		} else if time.Since(de.TS) <= cacheTTL {
-			mem.set(key, de.Title, de.Body, de.Full, de.Source)
-			return de.Title, de.Body, de.Full, de.Source
+	// Both --stop and SIGINT/SIGTERM end the accept loop, so the final
+	// flush below runs either way.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			shutdown()
+		case <-stop:
 		}
-	}
+	}()
 
-	var out, used string
-	source = "none"
+	// lookup resolves and shows one word for a socket request or a watched
+	// selection.
+	lookup := func(reqCfg config, word string) {
+		if !validPhrase(word) {
+			return
+		}
 
-	for _, cand := range lemmaCandidates(word) {
-		if o, err := lookupPrimary(client, cand); err == nil && o != "" {
-			out, used, source = o, cand, "online"
-			break
+		key := cacheKey(reqCfg.lang, word)
+		if !ded.allow(key) {
+			debugf(cfg, "dedupe: dropped repeat %q", key)
+			return
 		}
-	}
-	if out == "" {
-		for _, cand := range lemmaCandidates(word) {
-			if o, err := lookupWiktionary(client, cand); err == nil && o != "" {
-				out, used, source = o, cand, "wiktionary"
-				break
-			}
+
+		var de diskEntry
+		if !slots.run(lookupQueueWait, func() { de = resolveDefinition(ctx, reqCfg, p, mem, disk, word, client) }) {
+			debugf(cfg, "busy: dropped %q", key)
+			return
 		}
-	}
+		if ctx.Err() != nil {
+			return // shutting down
+		}
+		served.Add(1)
 
-	if out == "" && !cfg.noOffline {
-		for _, cand := range lemmaCandidates(word) {
-			if o, err := offlineLookup(p, cand); err == nil && o != "" {
-				out, used, source = o, cand, "offline"
-				break
+		if cfg.dnd == "suppress" || cfg.dnd == "queue" {
+			if dndActive(p) {
+				writeLast(word, de) // so --full and --last still have it
+				if cfg.dnd == "queue" {
+					held.push(reqCfg, word, de)
+				}
+				debugf(cfg, "dnd: %s %q", cfg.dnd, key)
+				return
 			}
 		}
+
+		replaces, stop := ded.replace(key)
+		if replaces != 0 {
+			debugf(cfg, "dedupe: replacing notification %d for %q", replaces, key)
+		}
+		// The Retry action, with --force-online so the network is asked again.
+		retry := func() diskEntry {
+			rc := reqCfg
+			rc.forceOnline = true
+			return resolveDefinition(ctx, rc, p, mem, disk, word, client)
+		}
+		ded.shown(key, notify(reqCfg, p, word, de, replaces, stop, retry), stop)
 	}
 
-	if out == "" {
-		out, used, source = "No definition found.", word, "none"
+	if cfg.dnd == "queue" {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			t := time.NewTicker(dndPoll)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+				}
+				if held.len() == 0 || dndActive(p) {
+					continue
+				}
+				for _, n := range held.take() {
+					notifyDBusAndHandleClick(n.cfg, p, n.word, n.de)
+				}
+			}
+		}()
 	}
 
-	showWord := cap1(word)
-	if used != "" && strings.ToLower(word) != used {
-		showWord = cap1(word) + " → " + cap1(used)
+	if cfg.watch {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			watchSelection(cfg, p, stop, func(sel string) {
+				inflight.Add(1)
+				go func() {
+					defer inflight.Done()
+					lookup(cfg, pickWord(sel))
+				}()
+			})
+		}()
 	}
 
-	full = strings.TrimSpace(out)
-	writeLast(full)
+accept:
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				break accept
+			default:
+				continue
+			}
+		}
+		inflight.Add(1)
+		go func(c net.Conn) {
+			defer inflight.Done()
+			defer c.Close()
+			_ = c.SetReadDeadline(time.Now().Add(900 * time.Millisecond))
+
+			msg := readMessage(c)
+
+			switch msg {
+			case ctrlStop:
+				shutdown()
+				return
+			case ctrlClear:
+				n := disk.reset()
+				mem.reset()
+				_, _ = c.Write([]byte(strconv.Itoa(n)))
+				return
+			case ctrlCompact:
+				n := disk.compact()
+				debugf(cfg, "compact: pruned %d expired disk entries", n)
+				_, _ = c.Write([]byte(strconv.Itoa(n)))
+				return
+			case ctrlStatus:
+				st := daemonStatus{
+					MemEntries:    mem.len(),
+					UptimeSeconds: int64(time.Since(started).Seconds()),
+					Served:        served.Load(),
+					Mem:           mem.stats(),
+				}
+				b, _ := json.Marshal(st)
+				_, _ = c.Write(b)
+				return
+			}
 
-	body = "<b><i>" + showWord + "</i></b>\n" + clampBody(full)
-	title = "📘 " + cap1(word) + " " + sourceEmoji(source)
+			reqCfg, text := parseRequest(cfg, msg)
 
-	mem.set(key, title, body, full, source)
-	disk[key] = diskEntry{Title: title, Body: body, Full: full, TS: time.Now(), Source: source}
-	*diskDirty = true
+			word := pickWord(text)
+			if reqCfg.phrase {
+				word = pickPhrase(text)
+			}
+			lookup(reqCfg, word)
+		}(conn)
+	}
 
-	return title, body, full, source
+	inflight.Wait()
+	disk.flush()
+	_ = os.Remove(sock)
+	return 0
 }
 
-type deduper struct {
-	mu   sync.Mutex
-	last map[string]time.Time
+// encodeRequest builds a lookup request for the daemon: "key: value" header
+// lines carrying the per-invocation flags, then the text on its own line.
+func encodeRequest(cfg config, word string) string {
+	var b strings.Builder
+	if cfg.lang != "" {
+		fmt.Fprintf(&b, "lang: %s\n", cfg.lang)
+	}
+	if cfg.forceOnline {
+		b.WriteString("force-online: true\n")
+	}
+	if cfg.pos != "" {
+		fmt.Fprintf(&b, "pos: %s\n", cfg.pos)
+	}
+	if cfg.allSources {
+		b.WriteString("all-sources: true\n")
+	}
+	if cfg.offlineOnly {
+		b.WriteString("offline-only: true\n")
+	}
+	if cfg.stem {
+		b.WriteString("stem: true\n")
+	}
+	if cfg.anyLang {
+		b.WriteString("any-lang: true\n")
+	}
+	if cfg.sequential {
+		b.WriteString("sequential: true\n")
+	}
+	if cfg.sound {
+		b.WriteString("sound: true\n")
+	}
+	if cfg.noMarkup {
+		b.WriteString("no-markup: true\n")
+	}
+	if cfg.noThesaurus {
+		b.WriteString("no-thesaurus: true\n")
+	}
+	if cfg.noEtymology {
+		b.WriteString("no-etymology: true\n")
+	}
+	if cfg.noOffline {
+		b.WriteString("no-offline: true\n")
+	}
+	if cfg.phrase {
+		b.WriteString("phrase: true\n")
+	}
+	if cfg.expire > 0 {
+		fmt.Fprintf(&b, "expire: %s\n", cfg.expire)
+	}
+	b.WriteString(word)
+	b.WriteString("\n")
+	return b.String()
 }
 
-func newDeduper() *deduper { return &deduper{last: map[string]time.Time{}} }
-
-func (d *deduper) allow(key string) bool {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	now := time.Now()
-	if t, ok := d.last[key]; ok && now.Sub(t) < dedupeWindow {
-		return false
+// parseRequest is the daemon side of encodeRequest. It returns cfg with the
+// request's headers applied, and the text to look up. A message without
+// headers (a bare word from an older client) is just the text. Unknown
+// headers and invalid values are ignored.
+func parseRequest(cfg config, msg string) (config, string) {
+	lines := strings.Split(msg, "\n")
+	for i, ln := range lines {
+		m := reqHeaderRe.FindStringSubmatch(strings.TrimSpace(ln))
+		if m == nil {
+			return cfg, strings.Join(lines[i:], "\n")
+		}
+		switch v := strings.ToLower(strings.TrimSpace(m[2])); m[1] {
+		case "lang":
+			if supportedLangs[v] {
+				cfg.lang = v
+			}
+		case "force-online":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.forceOnline = b
+			}
+		case "pos":
+			if partsOfSpeech[v] {
+				cfg.pos = v
+			}
+		case "all-sources":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.allSources = b
+			}
+		case "offline-only":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.offlineOnly = b
+			}
+		case "stem":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.stem = b
+			}
+		case "any-lang":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.anyLang = b
+			}
+		case "sequential":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.sequential = b
+			}
+		case "sound":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.sound = b
+			}
+		case "no-markup":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.noMarkup = b
+			}
+		case "no-thesaurus":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.noThesaurus = b
+			}
+		case "no-etymology":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.noEtymology = b
+			}
+		case "no-offline":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.noOffline = b
+			}
+		case "phrase":
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.phrase = b
+			}
+		case "expire":
+			if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+				cfg.expire = d
+			}
+		}
 	}
-	d.last[key] = now
-	return true
+	return cfg, ""
 }
 
-func notifyDBusAndHandleClick(p paths, summary, body, full string) {
-	conn, err := dbus.SessionBus()
-	if err != nil {
+// watchSelection calls fn with each new PRIMARY selection that is a single
+// word, until stop closes. wl-paste --watch runs its command on every
+// change with the selection on stdin; the command echoes it back with a
+// NUL terminator so multi-line selections stay in one piece.
+func watchSelection(cfg config, p paths, stop <-chan struct{}, fn func(sel string)) {
+	if p.wlPaste == "" {
+		fmt.Fprintln(os.Stderr, "define: --watch needs wl-paste (wl-clipboard)")
 		return
 	}
-	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
 
-	actions := []string{
-		"default", "Open full",
-		"full", "Open full",
-	}
-	hints := map[string]dbus.Variant{
-		"resident":  dbus.MakeVariant(true),
-		"transient": dbus.MakeVariant(false),
+	cmd := exec.CommandContext(ctx, p.wlPaste, "--primary", "--watch", "sh", "-c", `cat; printf '\000'`)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "define: --watch:", err)
+		return
 	}
-	var id uint32
-	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
-		appName, uint32(0), "", summary, body, actions, hints, int32(0),
-	)
-	if call.Err != nil {
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "define: --watch:", err)
 		return
 	}
-	_ = call.Store(&id)
+	defer func() { _ = cmd.Wait() }()
 
-	c := make(chan *dbus.Signal, 8)
-	conn.Signal(c)
-	_ = conn.AddMatchSignal(
-		dbus.WithMatchInterface("org.freedesktop.Notifications"),
-		dbus.WithMatchMember("ActionInvoked"),
-	)
+	sc := bufio.NewScanner(out)
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for sc.Scan() {
+		// Dragging across a sentence shouldn't define its first word, so
+		// only a selection that is one word on its own counts.
+		sel := strings.Trim(sc.Text(), selectionTrim)
+		if sel == "" || strings.ContainsAny(sel, " \t\n") {
+			continue
+		}
+		debugf(cfg, "watch: selection %q", sel)
+		fn(sel)
+	}
+}
 
-	go func() {
-		defer conn.RemoveSignal(c)
+// readMessage reads what a client sent until it closes its side, the read
+// deadline passes or daemonReadMax bytes arrive. Stream sockets don't keep
+// write boundaries, so a single Read could return just part of a phrase.
+func readMessage(r io.Reader) string {
+	b, _ := io.ReadAll(io.LimitReader(r, daemonReadMax))
+	return string(bytes.TrimSpace(b))
+}
 
-		timeout := time.NewTimer(10 * time.Minute)
-		defer timeout.Stop()
+// daemonStatus is the daemon's reply to ctrlStatus.
+type daemonStatus struct {
+	MemEntries    int      `json:"mem_entries"`
+	UptimeSeconds int64    `json:"uptime_seconds"`
+	Served        int64    `json:"lookups_served"`
+	Mem           lruStats `json:"mem"`
+}
 
-		for {
-			select {
-			case sig := <-c:
-				if sig == nil || len(sig.Body) < 2 {
-					continue
-				}
-				nid, ok := sig.Body[0].(uint32)
-				if !ok || nid != id {
-					continue
-				}
-				action, _ := sig.Body[1].(string)
-				if action == "default" || action == "full" {
-					openFullText(p, full)
-					return
-				}
-			case <-timeout.C:
-				return
-			}
+// printStatus reports whether the daemon is running (with its live counters)
+// and what the disk cache holds. The disk stats don't need the daemon.
+func printStatus() int {
+	sock := daemonSocketPath()
+	if _, err := os.Stat(sock); err != nil {
+		fmt.Println("daemon: not running")
+	} else if reply, err := sendControl(ctrlStatus); err != nil {
+		fmt.Printf("daemon: not running (stale socket %s)\n", sock)
+	} else {
+		var st daemonStatus
+		if json.Unmarshal([]byte(reply), &st) != nil {
+			fmt.Println("daemon: running (no status reply)")
+		} else {
+			fmt.Printf("daemon: running, up %s, %d lookups served, %d in memory\n",
+				time.Duration(st.UptimeSeconds)*time.Second, st.Served, st.MemEntries)
+			fmt.Printf("memory cache: %d/%d entries, %d hits, %d misses, %d evictions\n",
+				st.Mem.Size, memCacheMax, st.Mem.Hits, st.Mem.Misses, st.Mem.Evictions)
 		}
-	}()
-}
+	}
 
-func openFullText(p paths, full string) {
-	if p.zenity != "" {
-		cmd := exec.Command(p.zenity, "--text-info", "--width=760", "--height=560", "--title=define", "--no-markup")
-		cmd.Stdin = strings.NewReader(full)
-		_ = cmd.Run()
-		return
+	path := cacheFilePath()
+	disk := loadDiskCache(path)
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
 	}
-	fmt.Println(full)
+	fmt.Printf("cache: %d entries, %d bytes (%s)\n", len(disk), size, path)
+
+	var oldest, newest time.Time
+	for _, de := range disk {
+		if oldest.IsZero() || de.TS.Before(oldest) {
+			oldest = de.TS
+		}
+		if de.TS.After(newest) {
+			newest = de.TS
+		}
+	}
+	if len(disk) > 0 {
+		fmt.Printf("oldest entry: %s ago, newest: %s ago\n",
+			time.Since(oldest).Round(time.Second), time.Since(newest).Round(time.Second))
+	}
+	return 0
 }
 
-func openFullFromLast(p paths) {
-	b, err := os.ReadFile(lastFilePath())
+// sendControl delivers a control message to a running daemon and returns
+// whatever it replies before closing the connection.
+func sendControl(msg string) (string, error) {
+	conn, err := net.DialTimeout("unix", daemonSocketPath(), 80*time.Millisecond)
 	if err != nil {
-		return
+		return "", err
 	}
-	openFullText(p, string(b))
+	defer conn.Close()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	// Signal the end of the message; the daemon reads until EOF.
+	if uc, ok := conn.(*net.UnixConn); ok {
+		_ = uc.CloseWrite()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, _ := io.ReadAll(conn)
+	return strings.TrimSpace(string(reply)), nil
 }
 
-func runDaemon(cfg config, p paths) int {
-	sock := runtimeSocketPath()
-	_ = os.Remove(sock)
+// clientSend hands word to the daemon, or resolves and notifies in-process
+// when there is none. It returns the source of the definition, or "" when
+// the daemon took the request (its outcome isn't reported back).
+func clientSend(cfg config, word string) string {
+	if cfg.noDaemon {
+		debugf(cfg, "--no-daemon: resolving directly")
+	} else if conn, err := connectDaemon(cfg); err == nil {
+		_, _ = conn.Write([]byte(encodeRequest(cfg, word)))
+		_ = conn.Close()
+		return ""
+	} else {
+		debugf(cfg, "no daemon: %v", err)
+	}
+	p := resolvePaths()
+	de := resolveDirect(cfg, p, word)
+	notifyDBusAndHandleClick(cfg, p, word, de)
+	return de.Source
+}
 
-	ln, err := net.Listen("unix", sock)
+// connectDaemon dials the running daemon. With --autospawn, when there is
+// none it starts one and waits up to spawnWait for it to listen.
+func connectDaemon(cfg config) (net.Conn, error) {
+	sock := daemonSocketPath()
+	_, err := os.Stat(sock)
+	if err == nil {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("unix", sock, 80*time.Millisecond); err == nil {
+			return conn, nil
+		}
+	}
+	if !cfg.autospawn {
+		return nil, err
+	}
+	if err := spawnDaemon(); err != nil {
+		return nil, fmt.Errorf("autospawn: %w", err)
+	}
+	debugf(cfg, "autospawn: started a daemon")
+	for deadline := time.Now().Add(spawnWait); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if conn, err := net.DialTimeout("unix", daemonSocketPath(), 80*time.Millisecond); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errors.New("autospawn: the daemon didn't start listening")
+}
+
+// spawnDaemon starts "define --daemon" detached from this process: in its
+// own session, with no stdio, so it outlives the client and the terminal.
+// If two clients race, the loser's daemon finds the socket taken and exits.
+func spawnDaemon() error {
+	exe, err := os.Executable()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "listen:", err)
-		return 1
+		return err
 	}
-	defer ln.Close()
-	_ = os.Chmod(sock, 0o600)
+	cmd := exec.Command(exe, "--daemon")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
 
-	mem := newLRU(memCacheMax, cacheTTL)
+// resolveDirect resolves a word in-process, without the daemon, and saves
+// the disk cache if the lookup changed it.
+func resolveDirect(cfg config, p paths, word string) diskEntry {
+	client := newHTTPClient()
+	cfg.warmUp = true
+	mem := newLRU(64, 10*time.Minute)
+	disk := openDiskCache(cacheFilePath())
+	de := resolveDefinition(context.Background(), cfg, p, mem, disk, word, client)
+	disk.flush()
+	return de
+}
 
-	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		MaxIdleConns:        64,
-		MaxIdleConnsPerHost: 32,
-		IdleConnTimeout:     90 * time.Second,
-		ForceAttemptHTTP2:   true,
-	}
-	client := &http.Client{Transport: transport}
+type jsonResult struct {
+	Word   string    `json:"word"`
+	Lemma  string    `json:"lemma"`
+	Source string    `json:"source"`
+	Full   string    `json:"full"`
+	TS     time.Time `json:"timestamp"` // when the definition was fetched (UTC)
+}
 
-	diskPath := cacheFilePath()
-	disk := loadDiskCache(diskPath)
-	diskDirty := false
-	var diskMu sync.Mutex
+// replSeparator goes after each definition --repl prints.
+const replSeparator = "────────────────────────────────────────"
 
-	go func() {
-		t := time.NewTicker(2 * time.Second)
-		defer t.Stop()
-		for range t.C {
-			diskMu.Lock()
-			if diskDirty {
-				saveDiskCacheAtomic(diskPath, disk)
-				diskDirty = false
-			}
-			diskMu.Unlock()
-		}
-	}()
+// runREPL defines each line read from in, printing the title and full text
+// to out, until EOF, a blank line or ":q". One HTTP client and one set of
+// caches serve the whole session.
+func runREPL(cfg config, p paths, in io.Reader, out io.Writer) int {
+	pick, valid := pickWord, validWord
+	if cfg.phrase {
+		pick, valid = pickPhrase, validPhrase
+	}
+	prompt := ""
+	if f, ok := in.(*os.File); ok && isTerminal(f) {
+		prompt = "define> "
+	}
 
-	ded := newDeduper()
+	client := newHTTPClient()
+	cfg.warmUp = true
+	mem := newLRU(memCacheMax, cacheLifetime())
+	disk := openDiskCache(cacheFilePath())
+	defer disk.flush()
 
+	sc := bufio.NewScanner(in)
 	for {
-		conn, err := ln.Accept()
-		if err != nil {
+		fmt.Fprint(out, prompt)
+		if !sc.Scan() {
+			break
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line == ":q" {
+			break
+		}
+		word := pick(line)
+		if !valid(word) {
+			fmt.Fprintf(os.Stderr, "define: not a word: %q\n", line)
 			continue
 		}
-		go func(c net.Conn) {
-			defer c.Close()
-			_ = c.SetReadDeadline(time.Now().Add(900 * time.Millisecond))
-
-			r := bufio.NewReader(c)
-			buf := make([]byte, daemonReadMax)
-			n, _ := r.Read(buf)
-			word := pickWord(string(bytes.TrimSpace(buf[:n])))
+		de := resolveDefinition(context.Background(), cfg, p, mem, disk, word, client)
+		fmt.Fprintf(out, "%s\n%s\n%s\n", de.Title, de.Full, replSeparator)
+		disk.flush()
+	}
+	if prompt != "" {
+		fmt.Fprintln(out)
+	}
+	return 0
+}
 
-			if !validWord(word) {
-				return
-			}
+// printDryRun reports what a lookup of word would do — its cache entry,
+// candidates and sources — without touching the network or notifying.
+func printDryRun(cfg config, p paths, word string) int {
+	lang, key := lookupKey(cfg, word)
+	fmt.Printf("word:       %s\n", word)
+	fmt.Printf("lang:       %s\n", lang)
+	fmt.Printf("cache key:  %s\n", key)
 
-			key := strings.ToLower(word)
-			if !ded.allow(key) {
-				return
-			}
+	switch de, ok := loadDiskCache(cacheFilePath())[key]; {
+	case cfg.forceOnline:
+		fmt.Println("cache:      skipped (--force-online)")
+	case !ok:
+		fmt.Println("cache:      miss")
+	case expired(de, time.Now()):
+		fmt.Printf("cache:      expired %s entry from %s\n", de.Source, de.TS.Local().Format("2006-01-02 15:04"))
+	default:
+		fmt.Printf("cache:      hit (%s, %s) — no source would be asked\n", de.Source, de.TS.Local().Format("2006-01-02 15:04"))
+	}
 
-			diskMu.Lock()
-			title, body, full, _ := resolveDefinition(cfg, p, mem, disk, &diskDirty, word, client)
-			diskMu.Unlock()
+	var cands []string
+	for _, c := range lookupCandidates(cfg, word) {
+		if c.rule != "" {
+			cands = append(cands, c.word+" ("+c.rule+")")
+		} else {
+			cands = append(cands, c.word)
+		}
+	}
+	fmt.Printf("candidates: %s\n", strings.Join(cands, ", "))
 
-			notifyDBusAndHandleClick(p, title, body, full)
-		}(conn)
+	var names []string
+	order := "in order"
+	for _, s := range buildSources(lookupEnv{cfg: cfg, p: p, lang: lang}) {
+		names = append(names, s.name())
+		if s.online() && cfg.race && !cfg.allSources {
+			order = "online ones raced"
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("sources:    none enabled")
+	} else {
+		fmt.Printf("sources:    %s (%s)\n", strings.Join(names, " → "), order)
 	}
+	return 0
 }
 
-func clientSend(cfg config, word string) error {
-	sock := runtimeSocketPath()
-	if _, err := os.Stat(sock); err == nil {
-		conn, err := net.DialTimeout("unix", sock, 80*time.Millisecond)
-		if err == nil {
-			_, _ = conn.Write([]byte(word))
-			_ = conn.Close()
-			return nil
-		}
+// printJSON resolves word and writes it to stdout as JSON. It returns the
+// process exit code: exitNotFound when no source had a definition.
+func printJSON(cfg config, p paths, word string) int {
+	de := resolveDirect(cfg, p, word)
+	lemma := de.Lemma
+	if lemma == "" {
+		lemma = strings.ToLower(word)
 	}
-	p := resolvePaths()
-	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, ForceAttemptHTTP2: true}
-	client := &http.Client{Transport: transport}
-	mem := newLRU(64, 10*time.Minute)
-	disk := loadDiskCache(cacheFilePath())
-	dirty := false
-	title, body, full, _ := resolveDefinition(cfg, p, mem, disk, &dirty, word, client)
-	if dirty {
-		saveDiskCacheAtomic(cacheFilePath(), disk)
+	res := jsonResult{Word: word, Lemma: lemma, Source: de.Source, Full: de.Full, TS: de.TS.UTC()}
+	if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+		fmt.Fprintln(os.Stderr, "define:", err)
+		return 1
 	}
-	notifyDBusAndHandleClick(p, title, body, full)
-	return nil
+	return exitCode(de.Source)
 }
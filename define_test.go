@@ -0,0 +1,1976 @@
+// define — instant word definitions (Wayland + GNOME notifications)
+// Copyright (C) 2026 Rayan rayan6ms@gmail.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSessionType(t *testing.T) {
+	tests := []struct {
+		name, sessionType, wayland, display, want string
+	}{
+		{"explicit wayland", "wayland", "", "", "wayland"},
+		{"explicit x11", "x11", "wayland-0", "", "x11"},
+		{"wayland display", "", "wayland-0", ":0", "wayland"},
+		{"x11 display", "", "", ":0", "x11"},
+		{"unknown", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_SESSION_TYPE", tt.sessionType)
+			t.Setenv("WAYLAND_DISPLAY", tt.wayland)
+			t.Setenv("DISPLAY", tt.display)
+			if got := sessionType(); got != tt.want {
+				t.Errorf("sessionType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectionCommands(t *testing.T) {
+	all := paths{wlPaste: "/usr/bin/wl-paste", xclip: "/usr/bin/xclip", xsel: "/usr/bin/xsel"}
+	tests := []struct {
+		name    string
+		session string
+		p       paths
+		clip    bool
+		want    []string // first command tried
+	}{
+		{"wayland uses wl-paste primary", "wayland", all, false, []string{"/usr/bin/wl-paste", "-p", "--no-newline"}},
+		{"x11 uses xclip primary", "x11", all, false, []string{"/usr/bin/xclip", "-o", "-selection", "primary"}},
+		{"x11 falls back to xsel", "x11", paths{xsel: "/usr/bin/xsel"}, false, []string{"/usr/bin/xsel", "-o", "-p"}},
+		{"unknown prefers wl-paste", "", all, false, []string{"/usr/bin/wl-paste", "-p", "--no-newline"}},
+		{"unknown with only xclip", "", paths{xclip: "/usr/bin/xclip"}, false, []string{"/usr/bin/xclip", "-o", "-selection", "primary"}},
+		{"x11 without x tools", "x11", paths{wlPaste: "/usr/bin/wl-paste"}, false, nil},
+		{"no tools", "wayland", paths{}, false, nil},
+		{"--clipboard on wayland", "wayland", all, true, []string{"/usr/bin/wl-paste", "--no-newline"}},
+		{"--clipboard on x11", "x11", all, true, []string{"/usr/bin/xclip", "-o", "-selection", "clipboard"}},
+		{"--clipboard with only xsel", "x11", paths{xsel: "/usr/bin/xsel"}, true, []string{"/usr/bin/xsel", "-o", "-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds := selectionCommands(tt.session, tt.p, tt.clip)
+			if tt.want == nil {
+				if len(cmds) != 0 {
+					t.Fatalf("selectionCommands() = %v, want none", cmds)
+				}
+				return
+			}
+			if len(cmds) == 0 || !reflect.DeepEqual(cmds[0], tt.want) {
+				t.Fatalf("first command = %v, want %v", cmds, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyCommand(t *testing.T) {
+	all := paths{wlCopy: "/usr/bin/wl-copy", xclip: "/usr/bin/xclip", xsel: "/usr/bin/xsel"}
+	tests := []struct {
+		name    string
+		session string
+		p       paths
+		want    []string
+	}{
+		{"wayland uses wl-copy", "wayland", all, []string{"/usr/bin/wl-copy"}},
+		{"x11 uses xclip", "x11", all, []string{"/usr/bin/xclip", "-selection", "clipboard", "-in"}},
+		{"x11 falls back to xsel", "x11", paths{xsel: "/usr/bin/xsel"}, []string{"/usr/bin/xsel", "-b", "-i"}},
+		{"unknown prefers wl-copy", "", all, []string{"/usr/bin/wl-copy"}},
+		{"wayland without wl-copy", "wayland", paths{xclip: "/usr/bin/xclip"}, nil},
+		{"x11 without x tools", "x11", paths{wlCopy: "/usr/bin/wl-copy"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := copyCommand(tt.session, tt.p); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("copyCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestViewerCommand(t *testing.T) {
+	less := []string{"/usr/bin/less", "-R"}
+	tests := []struct {
+		name string
+		p    paths
+		tty  bool
+		want []string
+	}{
+		{"zenity first", paths{zenity: "/usr/bin/zenity", kdialog: "/usr/bin/kdialog"}, false,
+			[]string{"/usr/bin/zenity", "--text-info", "--width=760", "--height=560", "--title=define", "--no-markup", "--filename=/tmp/f"}},
+		{"kdialog", paths{kdialog: "/usr/bin/kdialog", yad: "/usr/bin/yad"}, false,
+			[]string{"/usr/bin/kdialog", "--title", "define", "--textbox", "/tmp/f", "760", "560"}},
+		{"yad", paths{yad: "/usr/bin/yad", xterm: "/usr/bin/xterm"}, true,
+			[]string{"/usr/bin/yad", "--text-info", "--width=760", "--height=560", "--title=define", "--filename=/tmp/f"}},
+		{"xterm without a terminal", paths{xterm: "/usr/bin/xterm"}, false,
+			[]string{"/usr/bin/xterm", "-T", "define", "-e", "/usr/bin/less", "-R", "/tmp/f"}},
+		{"terminal uses the pager directly", paths{xterm: "/usr/bin/xterm"}, true, nil},
+		{"nothing", paths{}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := viewerCommand(tt.p, less, "/tmp/f", tt.tty); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("viewerCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSelectedTextNoTools(t *testing.T) {
+	if got := getSelectedText(config{}, paths{}); got != "" {
+		t.Errorf("getSelectedText() = %q, want empty", got)
+	}
+}
+
+func TestPickNthWord(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"hello, world", 0, "hello"},
+		{"hello, world", 1, "world"},
+		{"  the quick brown fox\nnext line", 2, "brown"},
+		{"one two", 5, "one"},
+		{"one two", -1, "one"},
+		{"a “quoted” word", 1, "quoted"},
+		{"estab-\nlishment of", 0, "establishment"},
+		{"the estab-  \r\n   lishment", 1, "establishment"},
+		{"well-known fact", 0, "well-known"},
+		{"-- well-known --", 0, "well-known"},
+		{"—self-aware—", 0, "self-aware"},
+		{"a -\nb", 1, "a"},
+		{"", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := pickNthWord(tt.in, tt.n); got != tt.want {
+			t.Errorf("pickNthWord(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPickWordNormalizes(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"cafe\u0301 au lait", "caf\u00e9"}, // decomposed → composed
+		{"caf\u00e9", "caf\u00e9"},
+		{"“don’t”", "don't"},
+		{"ʼokina", "'okina"},
+	}
+	for _, tt := range tests {
+		got := pickWord(tt.in)
+		if got != tt.want {
+			t.Errorf("pickWord(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if !validWord(got) {
+			t.Errorf("validWord(%q) = false", got)
+		}
+	}
+	if got := pickPhrase("cafe\u0301  noir"); got != "caf\u00e9 noir" {
+		t.Errorf("pickPhrase() = %q, want composed form", got)
+	}
+	if cacheKey("fr", pickWord("cafe\u0301")) != cacheKey("fr", "caf\u00e9") {
+		t.Error("decomposed and composed input map to different cache keys")
+	}
+}
+
+func TestLemmaCandidates(t *testing.T) {
+	tests := []struct {
+		word, want string
+	}{
+		// irregular forms
+		{"mice", "mouse"},
+		{"feet", "foot"},
+		{"teeth", "tooth"},
+		{"geese", "goose"},
+		{"children", "child"},
+		{"women", "woman"},
+		{"knives", "knife"},
+		{"ran", "run"},
+		{"went", "go"},
+		{"spoke", "speak"},
+		{"bought", "buy"},
+		{"thought", "think"},
+		{"better", "good"},
+		{"worse", "bad"},
+
+		// suffix rules
+		{"legends", "legend"},
+		{"berries", "berry"},
+		{"running", "run"},
+		{"making", "make"},
+		{"calling", "call"},
+		{"stopped", "stop"},
+		{"walked", "walk"},
+		{"loved", "love"},
+		{"tried", "try"},
+		{"happier", "happy"},
+		{"happiest", "happy"},
+		{"bigger", "big"},
+		{"biggest", "big"},
+		{"nicer", "nice"},
+
+		// contractions and possessives
+		{"don't", "do"},
+		{"shouldn't", "should"},
+		{"won't", "will"},
+		{"isn't", "be"},
+		{"dog's", "dog"},
+		{"dogs'", "dog"},
+		{"children's", "child"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			var got []string
+			for _, c := range lemmaCandidates(tt.word) {
+				got = append(got, c.word)
+			}
+			if len(got) == 0 || got[0] != tt.word {
+				t.Fatalf("lemmaCandidates(%q) = %v, want the word itself first", tt.word, got)
+			}
+			if !slices.Contains(got, tt.want) {
+				t.Errorf("lemmaCandidates(%q) = %v, want it to include %q", tt.word, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPorterStem(t *testing.T) {
+	// Expected stems from Porter's paper and reference vocabulary.
+	tests := map[string]string{
+		"caresses": "caress", "ponies": "poni", "ties": "ti", "cats": "cat",
+		"feed": "feed", "agreed": "agre", "plastered": "plaster", "bled": "bled",
+		"motoring": "motor", "sing": "sing", "conflated": "conflat", "troubled": "troubl",
+		"sized": "size", "hopping": "hop", "tanned": "tan", "falling": "fall",
+		"hissing": "hiss", "fizzed": "fizz", "failing": "fail", "filing": "file",
+		"happy": "happi", "sky": "sky", "relational": "relat", "conditional": "condit",
+		"rational": "ration", "generalizations": "gener", "oscillators": "oscil",
+		"triplicate": "triplic", "formative": "form", "electrical": "electr",
+		"hopefulness": "hope", "goodness": "good", "revival": "reviv",
+		"allowance": "allow", "inference": "infer", "airliner": "airlin",
+		"adjustable": "adjust", "defensible": "defens", "irritant": "irrit",
+		"replacement": "replac", "adjustment": "adjust", "dependent": "depend",
+		"adoption": "adopt", "communism": "commun", "activate": "activ",
+		"angularity": "angular", "homologous": "homolog", "effective": "effect",
+		"bowdlerize": "bowdler", "probate": "probat", "rate": "rate", "cease": "ceas",
+		"controll": "control", "roll": "roll",
+
+		// left alone
+		"is": "is", "don't": "don't", "café": "café",
+	}
+	for word, want := range tests {
+		if got := porterStem(word); got != want {
+			t.Errorf("porterStem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestLookupCandidatesStem(t *testing.T) {
+	if got := lookupCandidates(config{}, "generalizations"); slices.Contains(got, lemma{"gener", "stem"}) {
+		t.Errorf("lookupCandidates() without --stem = %v", got)
+	}
+	got := lookupCandidates(config{stem: true}, "generalizations")
+	if got[0].word != "generalizations" || got[len(got)-1] != (lemma{"gener", "stem"}) {
+		t.Errorf("lookupCandidates(--stem) = %v, want the word first and the stem last", got)
+	}
+}
+
+func TestInflectionNote(t *testing.T) {
+	tests := []struct {
+		word, used, want string
+	}{
+		{"Running", "run", "running — present participle of run"},
+		{"tried", "try", "tried — past tense of try"},
+		{"biggest", "big", "biggest — superlative of big"},
+		{"mice", "mouse", "mice — inflected form of mouse"},
+		{"won't", "will", "won't — negative contraction of will"},
+		{"dog's", "dog", "dog's — possessive of dog"},
+		{"legend", "legend", ""},
+		{"legend", "", ""},
+	}
+	for _, tt := range tests {
+		if got := inflectionNote(tt.word, tt.used); got != tt.want {
+			t.Errorf("inflectionNote(%q, %q) = %q, want %q", tt.word, tt.used, got, tt.want)
+		}
+	}
+}
+
+func TestDeduperPrunes(t *testing.T) {
+	now := time.Now()
+	d := newDeduper(time.Second)
+	d.now = func() time.Time { return now }
+
+	for i := range 1000 {
+		d.allow(fmt.Sprintf("en:w%d", i))
+	}
+	if len(d.last) != 1000 {
+		t.Fatalf("len(last) = %d, want 1000", len(d.last))
+	}
+
+	now = now.Add(dedupePruneEvery)
+	d.allow("en:fresh")
+	if len(d.last) != 1 {
+		t.Errorf("after pruning len(last) = %d, want 1", len(d.last))
+	}
+	if d.allow("en:fresh") {
+		t.Error("pruning should keep keys still inside the window")
+	}
+}
+
+func TestDeduperWindow(t *testing.T) {
+	now := time.Now()
+	d := newDeduper(250 * time.Millisecond)
+	d.now = func() time.Time { return now }
+
+	if !d.allow("en:run") {
+		t.Fatal("first request was dropped")
+	}
+	now = now.Add(200 * time.Millisecond)
+	if d.allow("en:run") {
+		t.Error("repeat within the window was let through")
+	}
+	if !d.allow("en:walk") {
+		t.Error("a different word was dropped")
+	}
+	now = now.Add(300 * time.Millisecond)
+	if !d.allow("en:run") {
+		t.Error("repeat after the window was dropped")
+	}
+}
+
+func TestDeduperReplace(t *testing.T) {
+	d := newDeduper(time.Hour)
+	if !d.allow("en:run") || d.allow("en:run") {
+		t.Fatal("allow should pass the first request and drop a repeat within the window")
+	}
+
+	id, stop := d.replace("en:run")
+	if id != 0 {
+		t.Fatalf("first notification replaces %d, want 0", id)
+	}
+	d.shown("en:run", 7, stop)
+
+	id, stop2 := d.replace("en:run")
+	if id != 7 {
+		t.Fatalf("repeat replaces %d, want 7", id)
+	}
+	select {
+	case <-stop:
+	default:
+		t.Error("replacing should stop the old click handler")
+	}
+	d.shown("en:run", 7, stop2)
+
+	if id, _ := d.replace("en:walk"); id != 0 {
+		t.Errorf("a different word replaces %d, want 0", id)
+	}
+	select {
+	case <-stop2:
+		t.Error("a different word should leave the previous notification alone")
+	default:
+	}
+}
+
+func TestFormatTitle(t *testing.T) {
+	tests := []struct {
+		format, word, lemma, source, want string
+	}{
+		{"", "running", "run", "online", "📘 Running ☁️"},
+		{"{lemma} — {source}", "running", "run", "wiktionary", "Run — wiktionary"},
+		{"{lemma}", "legend", "", "online", "Legend"},
+		{"{word} {color}", "legend", "", "online", "Legend {color}"},
+	}
+	for _, tt := range tests {
+		if got := formatTitle(tt.format, tt.word, tt.lemma, tt.source); got != tt.want {
+			t.Errorf("formatTitle(%q, %q, %q, %q) = %q, want %q", tt.format, tt.word, tt.lemma, tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestDNDFromOutput(t *testing.T) {
+	tests := []struct {
+		tool, out string
+		want      bool
+	}{
+		{"dunstctl", "true", true},
+		{"dunstctl", "false", false},
+		{"makoctl", "default\ndo-not-disturb", true},
+		{"makoctl", "default", false},
+		{"swaync-client", "true", true},
+		{"gsettings", "false", true},
+		{"gsettings", "true", false},
+	}
+	for _, tt := range tests {
+		if got := dndFromOutput(tt.tool, tt.out); got != tt.want {
+			t.Errorf("dndFromOutput(%q, %q) = %v, want %v", tt.tool, tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestDNDQueueKeepsNewest(t *testing.T) {
+	var q dndQueue
+	for i := range dndQueueMax + 2 {
+		q.push(config{}, "", diskEntry{Title: fmt.Sprint(i)})
+	}
+	items := q.take()
+	if len(items) != dndQueueMax || items[0].de.Title != "2" {
+		t.Fatalf("queue held %d items from %q, want %d from \"2\"", len(items), items[0].de.Title, dndQueueMax)
+	}
+	if q.len() != 0 {
+		t.Error("take() should empty the queue")
+	}
+}
+
+func TestSoundName(t *testing.T) {
+	on := config{sound: true, soundFound: "message-new-instant", soundNone: "dialog-error"}
+	tests := []struct {
+		cfg    config
+		source string
+		want   string
+	}{
+		{config{soundFound: "message-new-instant"}, "online", ""}, // off by default
+		{on, "online", "message-new-instant"},
+		{on, "offline", "message-new-instant"},
+		{on, "none", "dialog-error"},
+	}
+	for _, tt := range tests {
+		if got := soundName(tt.cfg, tt.source); got != tt.want {
+			t.Errorf("soundName(sound=%v, %q) = %q, want %q", tt.cfg.sound, tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestLookupSlotsBoundConcurrency(t *testing.T) {
+	const limit, conns = 3, 12
+	slots := newLookupSlots(limit)
+	var running, peak, done atomic.Int32
+	var wg sync.WaitGroup
+	for range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ran := slots.run(time.Second, func() {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				running.Add(-1)
+				done.Add(1)
+			})
+			if !ran {
+				t.Error("lookup dropped while waiting less than its queue time")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("peak concurrency = %d, want at most %d", got, limit)
+	}
+	if got := done.Load(); got != conns {
+		t.Errorf("completed %d lookups, want %d", got, conns)
+	}
+}
+
+func TestLookupSlotsDropWhenFull(t *testing.T) {
+	slots := newLookupSlots(1)
+	release := make(chan struct{})
+	held := make(chan struct{})
+	go slots.run(time.Second, func() {
+		close(held)
+		<-release
+	})
+	<-held
+
+	// With the only slot busy, a lookup waits its queue time and is then
+	// dropped without running.
+	const wait = 30 * time.Millisecond
+	start := time.Now()
+	called := false
+	if slots.run(wait, func() { called = true }) || called {
+		t.Fatal("lookup ran while the only slot was held")
+	}
+	if took := time.Since(start); took < wait {
+		t.Errorf("dropped after %v, want it to wait %v first", took, wait)
+	}
+
+	// One that frees up within the wait still runs.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	if !slots.run(time.Second, func() { called = true }) || !called {
+		t.Fatal("lookup didn't run once the slot was released")
+	}
+}
+
+func TestNotificationBodyEscapesMarkup(t *testing.T) {
+	got := notificationBody("Salt & <pepper>", "NaCl: Na<sup>+</sup> & Cl<sup>-</sup>; x < y > z", bodyMaxChars)
+	want := "<b><i>Salt &amp; &lt;pepper&gt;</i></b>\nNaCl: Na&lt;sup&gt;+&lt;/sup&gt; &amp; Cl&lt;sup&gt;-&lt;/sup&gt;; x &lt; y &gt; z"
+	if got != want {
+		t.Errorf("notificationBody() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestParseWiktionaryStripsHTML(t *testing.T) {
+	payload := `{"en": [{"partOfSpeech": "Noun", "definitions": [
+		{"definition": "A <a rel=\"mw:WikiLink\" href=\"/wiki/story\" title=\"story\">story</a> of <i>unknown</i>\n   origin."},
+		{"definition": "Salt &amp; pepper, or x &lt; y."},
+		{"definition": "<span class=\"use-with-mention\">[obsolete]</span>  <b>Heading</b>"},
+		{"definition": "<span></span>"}
+	]}]}`
+	got, _, err := parseWiktionary(strings.NewReader(payload), "en", "", defsDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "• A story of unknown origin.\n• Salt & pepper, or x < y.\n• obsolete Heading"
+	if got != want {
+		t.Errorf("parseWiktionary() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestParseWiktionaryCapsDefinitions(t *testing.T) {
+	var defs []string
+	for range 10 {
+		defs = append(defs, `{"definition": "sense"}`)
+	}
+	payload := `{"en": [{"definitions": [` + strings.Join(defs, ",") + `]}]}`
+	got, _, err := parseWiktionary(strings.NewReader(payload), "en", "", defsDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(got, "• "); n != 7 {
+		t.Errorf("got %d bullets, want 7", n)
+	}
+	// A zero count, as in a config{}, means the default rather than one.
+	if got, _, _ := parseWiktionary(strings.NewReader(payload), "en", "", 0, false); strings.Count(got, "• ") != defsDefault {
+		t.Errorf("maxDefs 0: got %d bullets, want %d", strings.Count(got, "• "), defsDefault)
+	}
+}
+
+func TestParseWiktionaryPOS(t *testing.T) {
+	payload := `{"en": [
+		{"partOfSpeech": "Noun", "definitions": [{"definition": "A jog."}]},
+		{"partOfSpeech": "Verb", "definitions": [{"definition": "To move quickly."}]}
+	]}`
+	tests := []struct {
+		pos, want string
+	}{
+		{"", "• A jog.\n• To move quickly."},
+		{"verb", "• To move quickly."},
+		{"adverb", "• A jog.\n• To move quickly."}, // no match falls back to everything
+	}
+	for _, tt := range tests {
+		got, _, err := parseWiktionary(strings.NewReader(payload), "en", tt.pos, defsDefault, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("parseWiktionary(pos=%q) = %q, want %q", tt.pos, got, tt.want)
+		}
+	}
+}
+
+func TestParseWiktionaryAnyLang(t *testing.T) {
+	payload := `{
+		"fr": [{"partOfSpeech": "Noun", "language": "French", "definitions": [{"definition": "A trip."}]}],
+		"la": [{"partOfSpeech": "Verb", "language": "Latin", "definitions": [{"definition": "To go."}, {"definition": "To walk."}]}]
+	}`
+	if _, _, err := parseWiktionary(strings.NewReader(payload), "en", "", defsDefault, false); err == nil {
+		t.Error("parseWiktionary() without anyLang read another section")
+	}
+	got, used, err := parseWiktionary(strings.NewReader(payload), "en", "", defsDefault, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "From the Latin section:\n• To go.\n• To walk."; got != want || used != "la" {
+		t.Errorf("parseWiktionary() = %q, %q; want %q, \"la\"", got, used, want)
+	}
+	got, used, _ = parseWiktionary(strings.NewReader(payload), "fr", "", defsDefault, true)
+	if got != "• A trip." || used != "fr" {
+		t.Errorf("parseWiktionary(fr) = %q, %q; want the fr section unlabelled", got, used)
+	}
+}
+
+func TestParseWiktionaryLabels(t *testing.T) {
+	payload := `{"en": [{"partOfSpeech": "Noun", "definitions": [
+		{"definition": "<span class=\"usage-label-sense\"><span class=\"ib-brac\">(</span><span class=\"ib-content\"><a href=\"/wiki/informal\">informal</a>, <a href=\"/wiki/derogatory\">derogatory</a></span><span class=\"ib-brac\">)</span></span> A foolish person."},
+		{"definition": "A plain sense."}
+	]}]}`
+	got, _, err := parseWiktionary(strings.NewReader(payload), "en", "", defsDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "• noun (informal, derogatory): A foolish person.\n• A plain sense."
+	if got != want {
+		t.Errorf("parseWiktionary() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestParseEtymology(t *testing.T) {
+	extract := `== English ==
+
+
+=== Etymology ===
+From Middle English legende, from Old French legende,
+from Medieval Latin legenda.
+
+=== Pronunciation ===
+IPA: /ˈlɛd͡ʒənd/
+
+== French ==
+
+=== Etymology ===
+Borrowed from Latin.`
+	want := "From Middle English legende, from Old French legende, from Medieval Latin legenda."
+	if got := parseEtymology(extract); got != want {
+		t.Errorf("parseEtymology() = %q, want %q", got, want)
+	}
+
+	numbered := "== English ==\n=== Etymology 1 ===\nFrom Old English.\n=== Etymology 2 ===\nFrom Norse."
+	if got := parseEtymology(numbered); got != "From Old English." {
+		t.Errorf("parseEtymology(numbered) = %q, want the first section", got)
+	}
+
+	if got := parseEtymology("== French ==\n=== Etymology ===\nFrom Latin."); got != "" {
+		t.Errorf("parseEtymology(no English) = %q, want empty", got)
+	}
+}
+
+func TestReadMessageAssemblesChunks(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "s.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("unix", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("machine "))
+		time.Sleep(30 * time.Millisecond)
+		_, _ = c.Write([]byte("learning\n"))
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if got := readMessage(c); got != "machine learning" {
+		t.Errorf("readMessage() = %q, want %q", got, "machine learning")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    config
+		args    []string
+		wantErr string
+		want    func(config) bool
+	}{
+		{name: "word and flags", args: []string{"--race", "legend", "--pos=noun"}, want: func(c config) bool { return c.race && c.pos == "noun" }},
+		{name: "help", args: []string{"-h"}, want: func(c config) bool { return c.help }},
+		{name: "unknown flag", args: []string{"--colour"}, wantErr: `unknown flag "--colour"`},
+		{name: "leading dash is a word", args: []string{"-ism"}, want: func(c config) bool { return !c.help }},
+		{name: "offline-only vs force-online", args: []string{"--force-online", "--offline-only"}, wantErr: "--offline-only and --force-online"},
+		{name: "force-online vs no-offline", args: []string{"--no-offline", "--force-online"}, wantErr: "--force-online and --no-offline"},
+		{name: "json vs quiet", args: []string{"--json", "--quiet"}, wantErr: "--json and --quiet"},
+		{name: "expired-only alone", args: []string{"--expired-only"}, wantErr: "--expired-only needs --clear-cache"},
+		{name: "expired-only with clear-cache", args: []string{"--clear-cache", "--expired-only"}, want: func(c config) bool { return c.clearCache && c.expiredOnly }},
+		{
+			name: "flag beats config default",
+			base: config{forceOnline: true},
+			args: []string{"--offline-only"},
+			want: func(c config) bool { return c.offlineOnly && !c.forceOnline },
+		},
+		{name: "bad value is not fatal", args: []string{"--expire=soon"}, want: func(c config) bool { return c.expire == 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseArgs(tt.base, tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseArgs(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(cfg) {
+				t.Errorf("parseArgs(%q) = %+v", tt.args, cfg)
+			}
+		})
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	base := config{lang: "en"}
+	tests := []struct {
+		name, msg, text string
+		lang, pos       string
+		forceOnline     bool
+	}{
+		{"bare word", "legends", "legends", "en", "", false},
+		{"headers", "lang: es\nforce-online: true\npos: verb\ncorrer\n", "correr\n", "es", "verb", true},
+		{"phrase", "lang: en\nmachine learning", "machine learning", "en", "", false},
+		{"bad values ignored", "lang: xx\npos: gerund\nforce-online: maybe\nrun", "run", "en", "", false},
+		{"unknown header", "color: blue\nrun", "run", "en", "", false},
+		{"headers only", "lang: es\n", "", "es", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, text := parseRequest(base, tt.msg)
+			if text != tt.text || cfg.lang != tt.lang || cfg.pos != tt.pos || cfg.forceOnline != tt.forceOnline {
+				t.Errorf("parseRequest(%q) = {lang %q pos %q force %v} %q, want {lang %q pos %q force %v} %q",
+					tt.msg, cfg.lang, cfg.pos, cfg.forceOnline, text, tt.lang, tt.pos, tt.forceOnline, tt.text)
+			}
+		})
+	}
+}
+
+func TestConfigFullViewIgnored(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	if err := os.MkdirAll(filepath.Join(dir, "define"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configFilePath(), []byte("full_view = true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	base := loadConfig()
+	if base.fullView {
+		t.Fatal("full_view in config.toml set fullView")
+	}
+	for _, args := range [][]string{{"--daemon"}, {"--status"}} {
+		cfg, err := parseArgs(base, args)
+		if err != nil {
+			t.Fatalf("parseArgs(%q): %v", args, err)
+		}
+		if cfg.fullView || !cfg.daemon && !cfg.status {
+			t.Errorf("parseArgs(%q) = fullView %v, daemon %v, status %v", args, cfg.fullView, cfg.daemon, cfg.status)
+		}
+	}
+}
+
+func TestLookupKey(t *testing.T) {
+	tests := []struct {
+		cfg  config
+		want string
+	}{
+		{config{}, "run"},
+		{config{lang: "es"}, "es:run"},
+		{config{pos: "verb"}, "run#verb"},
+		{config{allSources: true, offlineOnly: true}, "run+all+offline"},
+		{config{stem: true}, "run+stem"},
+		{config{anyLang: true}, "run+anylang"},
+	}
+	for _, tt := range tests {
+		if _, key := lookupKey(tt.cfg, "run"); key != tt.want {
+			t.Errorf("lookupKey(%+v) = %q, want %q", tt.cfg, key, tt.want)
+		}
+	}
+}
+
+func TestAnyLangNotCachedForPlainLookups(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	serveFixture(t, &wiktionaryAPI, "/definition/%s", http.StatusOK,
+		`{"la": [{"partOfSpeech": "Verb", "language": "Latin", "definitions": [{"definition": "To go."}]}]}`)
+	serveFixture(t, &datamuseAPI, "/words?%s=%s&max=%d", http.StatusOK, `[]`)
+	serveFixture(t, &extractAPI, "/extract?%s", http.StatusOK, `{}`)
+
+	cfg := config{lang: "en", sources: []string{"wiktionary"}, noThesaurus: true, noEtymology: true}
+	mem := newLRU(memCacheMax, time.Hour)
+	disk := &diskCache{path: filepath.Join(t.TempDir(), "cache.json"), m: map[string]diskEntry{}, now: time.Now}
+	ctx := context.Background()
+
+	anyCfg := cfg
+	anyCfg.anyLang = true
+	if de := resolveDefinition(ctx, anyCfg, paths{}, mem, disk, "ire", http.DefaultClient); de.Source != "wiktionary" {
+		t.Fatalf("--any-lang lookup answered from %q, want wiktionary", de.Source)
+	}
+	if de := resolveDefinition(ctx, cfg, paths{}, mem, disk, "ire", http.DefaultClient); de.Source != "none" || strings.Contains(de.Full, "Latin") {
+		t.Errorf("plain lookup after --any-lang = %q from %q, want a miss", de.Full, de.Source)
+	}
+}
+
+func TestNoThesaurusNotServedFromCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	serveFixture(t, &wiktionaryAPI, "/definition/%s", http.StatusOK,
+		`{"en": [{"partOfSpeech": "Adjective", "language": "English", "definitions": [{"definition": "Feeling joy."}]}]}`)
+	serveFixture(t, &datamuseAPI, "/words?%s=%s&max=%d", http.StatusOK, `[{"word": "joyful"}]`)
+
+	cfg := config{lang: "en", sources: []string{"wiktionary"}, noEtymology: true}
+	mem := newLRU(memCacheMax, time.Hour)
+	disk := &diskCache{path: filepath.Join(t.TempDir(), "cache.json"), m: map[string]diskEntry{}, now: time.Now}
+	ctx := context.Background()
+
+	if de := resolveDefinition(ctx, cfg, paths{}, mem, disk, "happy", http.DefaultClient); !strings.Contains(de.Full, "Synonyms: joyful") {
+		t.Fatalf("plain lookup = %q, want synonyms", de.Full)
+	}
+	cfg.noThesaurus = true
+	if de := resolveDefinition(ctx, cfg, paths{}, mem, disk, "happy", http.DefaultClient); strings.Contains(de.Full, "Synonyms") {
+		t.Errorf("--no-thesaurus lookup = %q, want no synonyms", de.Full)
+	}
+}
+
+func TestNoEtymologyNotServedFromCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	serveFixture(t, &wiktionaryAPI, "/definition/%s", http.StatusOK,
+		`{"en": [{"partOfSpeech": "Adjective", "language": "English", "definitions": [{"definition": "Feeling joy."}]}]}`)
+	serveFixture(t, &extractAPI, "/extract?%s", http.StatusOK,
+		`{"query": {"pages": {"1": {"extract": "== English ==\n=== Etymology ===\nFrom Middle English hap."}}}}`)
+
+	cfg := config{lang: "en", sources: []string{"wiktionary"}, noThesaurus: true}
+	mem := newLRU(memCacheMax, time.Hour)
+	disk := &diskCache{path: filepath.Join(t.TempDir(), "cache.json"), m: map[string]diskEntry{}, now: time.Now}
+	ctx := context.Background()
+
+	if de := resolveDefinition(ctx, cfg, paths{}, mem, disk, "happy", http.DefaultClient); !strings.Contains(de.Full, "Middle English") {
+		t.Fatalf("plain lookup = %q, want the etymology", de.Full)
+	}
+	cfg.noEtymology = true
+	if de := resolveDefinition(ctx, cfg, paths{}, mem, disk, "happy", http.DefaultClient); strings.Contains(de.Full, "Middle English") {
+		t.Errorf("--no-etymology lookup = %q, want no etymology", de.Full)
+	}
+}
+
+func TestEncodeRequestRoundTrip(t *testing.T) {
+	// Every field that changes what the daemon looks up or shows.
+	tests := []config{
+		{lang: "fr"},
+		{forceOnline: true},
+		{pos: "noun"},
+		{allSources: true},
+		{offlineOnly: true},
+		{stem: true},
+		{anyLang: true},
+		{sequential: true},
+		{sound: true},
+		{noMarkup: true},
+		{noThesaurus: true},
+		{noEtymology: true},
+		{noOffline: true},
+		{phrase: true},
+		{expire: 8 * time.Second},
+		{lang: "es", pos: "verb", stem: true, noThesaurus: true, expire: 1500 * time.Millisecond},
+	}
+	for _, in := range tests {
+		cfg, text := parseRequest(config{}, encodeRequest(in, "maison"))
+		if !reflect.DeepEqual(cfg, in) || pickWord(text) != "maison" {
+			t.Errorf("round trip of %+v = %+v, %q", in, cfg, text)
+		}
+	}
+	if cfg, text := parseRequest(config{}, encodeRequest(config{phrase: true}, "ice cream")); !cfg.phrase || pickPhrase(text) != "ice cream" {
+		t.Errorf("phrase round trip = phrase %v, %q", cfg.phrase, text)
+	}
+}
+
+func TestPlainBody(t *testing.T) {
+	body := notificationBody("R&D", "noun\n  1. Research <and> development.", 500)
+	if got, want := plainBody(body), "R&D\nnoun\n  1. Research <and> development."; got != want {
+		t.Errorf("plainBody() = %q, want %q", got, want)
+	}
+}
+
+func TestNotifyArgsFollowsCaps(t *testing.T) {
+	cfg := config{sound: true, soundFound: "message-new-instant"}
+	de := diskEntry{Body: notificationBody("Run", "verb", 500), Source: "online"}
+
+	full := map[string]bool{"actions": true, "body-markup": true, "persistence": true, "sound": true}
+	body, actions, hints := notifyArgs(cfg, paths{}, de, full, false)
+	if body != de.Body || len(actions) < 4 {
+		t.Errorf("full caps: body %q, actions %q", body, actions)
+	}
+	for _, h := range []string{"resident", "transient", "sound-name"} {
+		if _, ok := hints[h]; !ok {
+			t.Errorf("full caps: no %s hint in %v", h, hints)
+		}
+	}
+
+	body, actions, hints = notifyArgs(cfg, paths{}, de, map[string]bool{"body": true}, false)
+	if body != "Run\nverb" || actions != nil || len(hints) != 0 {
+		t.Errorf("minimal caps: body %q, actions %q, hints %v", body, actions, hints)
+	}
+
+	down := diskEntry{Source: "unreachable", Lemma: "run"}
+	if _, actions, _ := notifyArgs(cfg, paths{}, down, full, true); !slices.Contains(actions, "retry") {
+		t.Errorf("unreachable: actions %q, want retry", actions)
+	}
+	if _, actions, _ := notifyArgs(cfg, paths{}, down, full, false); slices.Contains(actions, "retry") {
+		t.Errorf("unreachable without a retry func: actions %q", actions)
+	}
+	miss := diskEntry{Source: "none", Lemma: "runn"}
+	if _, actions, _ := notifyArgs(cfg, paths{xdgOpen: "/usr/bin/xdg-open"}, miss, full, true); !slices.Contains(actions, "search") || slices.Contains(actions, "retry") {
+		t.Errorf("not found: actions %q, want search and no retry", actions)
+	}
+	if _, actions, _ := notifyArgs(cfg, paths{}, miss, full, true); slices.Contains(actions, "search") {
+		t.Errorf("not found without xdg-open: actions %q", actions)
+	}
+	found := diskEntry{Source: "online", Lemma: "run"}
+	if _, actions, _ := notifyArgs(cfg, paths{xdgOpen: "/usr/bin/xdg-open"}, found, full, true); !slices.Contains(actions, "browser") {
+		t.Errorf("found: actions %q, want browser", actions)
+	}
+	if _, actions, _ := notifyArgs(cfg, paths{}, found, full, true); slices.Contains(actions, "browser") {
+		t.Errorf("found without xdg-open: actions %q", actions)
+	}
+
+	cfg.expire = 8 * time.Second
+	if _, _, hints := notifyArgs(cfg, paths{}, de, full, false); len(hints) != 2 {
+		t.Errorf("resident hint sent with an expire timeout: %v", hints)
+	}
+}
+
+const dictLegendOutput = `1 definition found
+
+From The Collaborative International Dictionary of English v.0.48 [gcide]:
+
+  Legend \Leg"end\ (l[e^]j"[e^]nd), n. [OE. legende, F. l['e]gende,
+     LL. legenda, fr. L. legendus to be read.]
+     1. That which is appointed to be read; especially, a chronicle
+        or register of the lives of saints. [Obs.]
+        [1913 Webster]
+
+     2. A story respecting saints; especially, one of a marvelous
+        nature.
+        [1913 Webster]
+`
+
+func TestParseOfflineOutput(t *testing.T) {
+	got, err := parseOfflineOutput(dictLegendOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1. That which is appointed to be read; especially, a chronicle\n" +
+		"or register of the lives of saints.\n" +
+		"\n" +
+		"2. A story respecting saints; especially, one of a marvelous\n" +
+		"nature."
+	if got != want {
+		t.Errorf("parseOfflineOutput() =\n%q\nwant\n%q", got, want)
+	}
+
+	for _, out := range []string{"", "  \n", "No definitions found for \"xyzzy\", perhaps you mean:"} {
+		if got, err := parseOfflineOutput(out); err == nil {
+			t.Errorf("parseOfflineOutput(%q) = %q, want an error", out, got)
+		}
+	}
+}
+
+func FuzzParseOfflineOutput(f *testing.F) {
+	f.Add(dictLegendOutput)
+	f.Add("wn: run\n  n 1: a score in baseball\n  v 2: move fast\n.\n")
+	f.Add("The end.\n\n\n\nA [tag] line\r\n")
+	f.Fuzz(func(t *testing.T, raw string) {
+		out, err := parseOfflineOutput(raw)
+		if err != nil {
+			if out != "" {
+				t.Fatalf("error %v with non-empty output %q", err, out)
+			}
+			return
+		}
+		if out == "" || out != strings.TrimSpace(out) {
+			t.Fatalf("output %q is empty or untrimmed", out)
+		}
+		if n := strings.Count(out, "\n") + 1; n > 48 {
+			t.Fatalf("%d output lines, want at most 48", n)
+		}
+		if len(out) > len(raw) {
+			t.Fatalf("output (%d bytes) longer than input (%d bytes)", len(out), len(raw))
+		}
+	})
+}
+
+// serveFixture points *api at an httptest.Server that answers every request
+// with status and body, restoring the real URL when the test ends.
+func serveFixture(t *testing.T, api *string, path string, status int, body string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	old := *api
+	*api = srv.URL + path
+	t.Cleanup(func() { *api = old })
+}
+
+const primaryFixture = `[{
+	"word": "run",
+	"phonetic": "/ɹʌn/",
+	"phonetics": [{"text": "/ɹʌn/", "audio": "https://example.org/run.mp3"}],
+	"meanings": [
+		{"partOfSpeech": "verb", "definitions": [{"definition": "To move swiftly.", "example": "Run to the shop."}, {"definition": "unused"}]},
+		{"partOfSpeech": "noun", "definitions": [{"definition": "An act of running."}]},
+		{"partOfSpeech": "adjective", "definitions": []},
+		{"partOfSpeech": "interjection", "definitions": [{"definition": "Flee!"}]},
+		{"partOfSpeech": "adverb", "definitions": [{"definition": "Past the cap."}]}
+	]
+}]`
+
+func TestLookupPrimaryFixtures(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		want      string
+		wantAudio string
+		wantErr   bool
+	}{
+		{
+			name:   "multiple meanings",
+			status: http.StatusOK,
+			body:   primaryFixture,
+			want: "/ɹʌn/\nverb\nTo move swiftly.\nExample: Run to the shop.\n\n" +
+				"noun\nAn act of running.\n\n" +
+				"interjection\nFlee!",
+			wantAudio: "https://example.org/run.mp3",
+		},
+		{name: "empty meanings", status: http.StatusOK, body: `[{"word": "run", "meanings": []}]`, wantErr: true},
+		{name: "not found", status: http.StatusNotFound, body: `{"title": "No Definitions Found"}`, wantErr: true},
+		{name: "malformed json", status: http.StatusOK, body: `[{"word": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveFixture(t, &primaryAPI, "/entries/%s/%s", tt.status, tt.body)
+			got, audio, err := lookupPrimary(context.Background(), http.DefaultClient, "en", "run", "", meaningsDefault, examplesDefault)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lookupPrimary() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || audio != tt.wantAudio {
+				t.Errorf("lookupPrimary() =\n%q, %q\nwant\n%q, %q", got, audio, tt.want, tt.wantAudio)
+			}
+		})
+	}
+}
+
+func TestLookupPrimaryExamples(t *testing.T) {
+	body := `[{"word": "run", "meanings": [{"partOfSpeech": "verb", "definitions": [
+		{"definition": "To move swiftly.", "example": "Run to the shop."},
+		{"definition": "To flow."},
+		{"definition": "To operate.", "example": "The engine runs."},
+		{"definition": "To manage.", "example": "She runs a shop."}
+	]}]}]`
+	serveFixture(t, &primaryAPI, "/entries/%s/%s", http.StatusOK, body)
+	got, _, err := lookupPrimary(context.Background(), http.DefaultClient, "en", "run", "", meaningsDefault, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "verb\nTo move swiftly.\nExamples:\n• Run to the shop.\n• The engine runs."
+	if got != want {
+		t.Errorf("lookupPrimary(examples=2) =\n%q\nwant\n%q", got, want)
+	}
+
+	// Zero counts, as in a config{}, mean the defaults.
+	if got, _, _ := lookupPrimary(context.Background(), http.DefaultClient, "en", "run", "", 0, 0); got != "verb\nTo move swiftly.\nExample: Run to the shop." {
+		t.Errorf("lookupPrimary(0, 0) = %q, want the default one example", got)
+	}
+	if got, _, _ := lookupPrimary(context.Background(), http.DefaultClient, "en", "run", "", 0, noExamples); got != "verb\nTo move swiftly." {
+		t.Errorf("lookupPrimary(noExamples) = %q, want no examples", got)
+	}
+	var cfg config
+	if err := applyConfigLine(&cfg, "examples = 0"); err != nil || cfg.maxExamples != noExamples {
+		t.Errorf("examples = 0: maxExamples %d, err %v; want noExamples", cfg.maxExamples, err)
+	}
+}
+
+func TestLookupMeans(t *testing.T) {
+	serveFixture(t, &datamuseAPI, "/words?%s=%s&max=%d", http.StatusOK, `[
+		{"word": "loquacity", "defs": ["n\tthe quality of being talkative", "n\tgarrulousness"]},
+		{"word": " "},
+		{"word": "verbosity"},
+		{"word": "prolixity", "defs": ["n\tboring verbosity"]}
+	]`)
+	words, err := lookupMeans(context.Background(), http.DefaultClient, "excessive talking", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 2 || words[0].Word != "loquacity" || words[1].Word != "verbosity" {
+		t.Fatalf("lookupMeans() = %+v, want loquacity and verbosity", words)
+	}
+
+	de := meansEntry(config{bodyMax: bodyMaxChars}, "excessive talking", words)
+	if want := "• loquacity — (n) the quality of being talkative\n• verbosity"; de.Body != want {
+		t.Errorf("body = %q, want %q", de.Body, want)
+	}
+	if !strings.Contains(de.Full, "loquacity\n  (n) the quality of being talkative\n  (n) garrulousness\nverbosity") {
+		t.Errorf("full view = %q, want every definition", de.Full)
+	}
+	if de := meansEntry(config{bodyMax: bodyMaxChars}, "zzz", nil); de.Source != "none" {
+		t.Errorf("no candidates: source = %q, want none", de.Source)
+	}
+}
+
+func TestLookupWiktionaryFixtures(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "definitions",
+			status: http.StatusOK,
+			body:   `{"en": [{"partOfSpeech": "Noun", "definitions": [{"definition": "A <b>story</b>."}, {"definition": ""}, {"definition": "A key."}]}]}`,
+			want:   "• A story.\n• A key.",
+		},
+		{name: "other language only", status: http.StatusOK, body: `{"fr": [{"definitions": [{"definition": "Une histoire."}]}]}`, wantErr: true},
+		{name: "not found", status: http.StatusNotFound, body: `{"title": "Not found."}`, wantErr: true},
+		{name: "malformed json", status: http.StatusOK, body: `{"en": [`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveFixture(t, &wiktionaryAPI, "/definition/%s", tt.status, tt.body)
+			got, _, err := lookupWiktionary(context.Background(), http.DefaultClient, "en", "legend", "", defsDefault, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lookupWiktionary() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("lookupWiktionary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func sourceNames(srcs []dictSource) []string {
+	var out []string
+	for _, s := range srcs {
+		out = append(out, s.name())
+	}
+	return out
+}
+
+// fakeSource answers the words in defs after their delay, and fails every
+// other word after miss.
+type fakeSource struct {
+	defs  map[string]time.Duration
+	miss  time.Duration
+	calls atomic.Int32
+}
+
+func (*fakeSource) name() string  { return "fake" }
+func (*fakeSource) online() bool  { return true }
+func (*fakeSource) enabled() bool { return true }
+func (f *fakeSource) lookup(ctx context.Context, word string) (string, string, error) {
+	f.calls.Add(1)
+	d, ok := f.defs[word]
+	if !ok {
+		d = f.miss
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+	if !ok {
+		return "", "", errors.New("not found")
+	}
+	return "def of " + word, "", nil
+}
+
+func TestLookupFirst(t *testing.T) {
+	// Only the second candidate matches: all three run at once, so the
+	// answer comes after one delay rather than three.
+	src := &fakeSource{defs: map[string]time.Duration{"run": 50 * time.Millisecond}, miss: 50 * time.Millisecond}
+	start := time.Now()
+	text, _, used, _ := lookupFirst(context.Background(), config{}, src, "running")
+	if text != "def of run" || used != "run" {
+		t.Errorf("lookupFirst() = %q via %q, want run's definition", text, used)
+	}
+	if took := time.Since(start); took > 140*time.Millisecond {
+		t.Errorf("lookupFirst() took %v; the candidates didn't run concurrently", took)
+	}
+
+	// The word itself wins over a faster lemma.
+	src = &fakeSource{defs: map[string]time.Duration{"running": 60 * time.Millisecond, "run": time.Millisecond}}
+	if text, _, used, _ := lookupFirst(context.Background(), config{}, src, "running"); used != "running" {
+		t.Errorf("lookupFirst() = %q via %q, want the original word preferred", text, used)
+	}
+
+	// --sequential stops at the first match.
+	src = &fakeSource{defs: map[string]time.Duration{"running": 0, "run": 0}}
+	if _, _, used, _ := lookupFirst(context.Background(), config{sequential: true}, src, "running"); used != "running" || src.calls.Load() != 1 {
+		t.Errorf("sequential lookupFirst() used %q after %d calls, want running after 1", used, src.calls.Load())
+	}
+
+	// A miss is a plain no; every candidate timing out is a failure.
+	src = &fakeSource{}
+	if _, _, _, fail := lookupFirst(context.Background(), config{}, src, "running"); fail != nil {
+		t.Errorf("lookupFirst() of a miss failed with %v, want nil", fail)
+	}
+	t.Cleanup(func() { sourceBreakers.record("fake", nil) })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	src = &fakeSource{miss: time.Second}
+	if _, _, _, fail := lookupFirst(ctx, config{}, src, "running"); !isTimeout(fail) {
+		t.Errorf("lookupFirst() that timed out failed with %v, want a timeout", fail)
+	}
+}
+
+func TestOutage(t *testing.T) {
+	var o outage
+	o.add(statusError(503))
+	o.add(errBreakerOpen)
+	if err := o.err(); err == nil || isTimeout(err) {
+		t.Errorf("503 + open breaker: err() = %v, want a non-timeout failure", err)
+	}
+	o.add(context.DeadlineExceeded)
+	if err := o.err(); !isTimeout(err) {
+		t.Errorf("with a deadline: err() = %v, want a timeout", err)
+	}
+	o.add(statusError(404))
+	if err := o.err(); err != nil {
+		t.Errorf("after a 404: err() = %v, want nil", err)
+	}
+	if err := (outage{}).err(); err != nil {
+		t.Errorf("nothing added: err() = %v", err)
+	}
+}
+
+func TestBuildSources(t *testing.T) {
+	t.Setenv("DEFINE_MW_KEY", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir()) // no custom.json
+	tests := []struct {
+		name string
+		cfg  config
+		lang string
+		want []string
+	}{
+		{"default order without a key", config{}, "en", []string{"online", "wiktionary", "offline"}},
+		{"configured order", config{sources: []string{"offline", "wiktionary"}}, "en", []string{"offline", "wiktionary"}},
+		{"no offline", config{noOffline: true}, "en", []string{"online", "wiktionary"}},
+		{"force online", config{forceOnline: true, sources: []string{"offline", "online"}}, "en", []string{"online"}},
+		{"offline only", config{offlineOnly: true}, "en", []string{"offline"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sourceNames(buildSources(lookupEnv{cfg: tt.cfg, lang: tt.lang}))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("buildSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("DEFINE_MW_KEY", "k")
+	if got, want := sourceNames(buildSources(lookupEnv{lang: "en"})), []string{"mw", "online", "wiktionary", "offline"}; !slices.Equal(got, want) {
+		t.Errorf("buildSources(with key) = %v, want %v", got, want)
+	}
+	if got := sourceNames(buildSources(lookupEnv{lang: "es"})); slices.Contains(got, "mw") {
+		t.Errorf("buildSources(lang=es) = %v, want no mw", got)
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := newBreakers()
+	b.now = func() time.Time { return now }
+	down := statusError(http.StatusServiceUnavailable)
+
+	for i := range breakerThreshold {
+		if !b.allow("online") {
+			t.Fatalf("blocked after %d failures", i)
+		}
+		b.record("online", down)
+	}
+	if b.allow("online") {
+		t.Fatal("allowed while open")
+	}
+	if !b.allow("wiktionary") {
+		t.Fatal("other sources should not be affected")
+	}
+
+	now = now.Add(breakerCooldown)
+	if !b.allow("online") {
+		t.Fatal("no probe after the cool-down")
+	}
+	if b.allow("online") {
+		t.Fatal("second request allowed while probing")
+	}
+	b.record("online", down)
+	if b.allow("online") {
+		t.Fatal("allowed after a failed probe")
+	}
+
+	now = now.Add(breakerCooldown)
+	if !b.allow("online") {
+		t.Fatal("no probe after the second cool-down")
+	}
+	b.record("online", statusError(http.StatusNotFound)) // answered: not an outage
+	if !b.allow("online") || !b.allow("online") {
+		t.Fatal("still blocked after a successful probe")
+	}
+}
+
+func TestBreakersWindow(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := newBreakers()
+	b.now = func() time.Time { return now }
+	for range breakerThreshold - 1 {
+		b.record("online", context.DeadlineExceeded)
+	}
+	now = now.Add(breakerWindow + time.Second)
+	b.record("online", context.DeadlineExceeded)
+	if !b.allow("online") {
+		t.Error("failures spread past the window should not open the breaker")
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	cert := srv.Certificate()
+	pin := spkiPin(cert)
+
+	pins := parsePins("api.example.org=sha256/" + pin + ", bogus, other.example.org=" + strings.Repeat("A", 43) + "=")
+	if len(pins) != 2 || pins["api.example.org"][0] != pin {
+		t.Fatalf("parsePins() = %v", pins)
+	}
+	verify := verifyPins(pins)
+	state := func(host string) tls.ConnectionState {
+		return tls.ConnectionState{ServerName: host, PeerCertificates: []*x509.Certificate{cert}}
+	}
+	if err := verify(state("API.example.org")); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	if err := verify(state("other.example.org")); err == nil {
+		t.Error("a key that isn't pinned was accepted")
+	}
+	if err := verify(state("unpinned.example.org")); err != nil {
+		t.Errorf("unpinned host: %v", err)
+	}
+}
+
+func TestTLSConfigMinVersion(t *testing.T) {
+	t.Setenv("DEFINE_TLS_PINS", "")
+	t.Setenv("DEFINE_TLS_MIN", "")
+	if c := tlsConfig(); c.MinVersion != tls.VersionTLS12 || c.VerifyConnection != nil {
+		t.Errorf("default tlsConfig() = min %x, pinning %v", c.MinVersion, c.VerifyConnection != nil)
+	}
+	t.Setenv("DEFINE_TLS_MIN", "1.3")
+	if c := tlsConfig(); c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("DEFINE_TLS_MIN=1.3: min %x", c.MinVersion)
+	}
+}
+
+func TestRuntimeSocketPath(t *testing.T) {
+	perUser := fmt.Sprintf("define-%d.sock", os.Getuid())
+	tests := []struct {
+		name, runtimeDir, tmpDir, want string
+	}{
+		{"runtime dir", "/run/user/1000", "", "/run/user/1000/define.sock"},
+		{"runtime dir with trailing slash", "/run/user/1000/", "", "/run/user/1000/define.sock"},
+		{"unset falls back to /tmp", "", "", "/tmp/" + perUser},
+		{"unset uses TMPDIR", "", "/var/tmp/me", "/var/tmp/me/" + perUser},
+		{"runtime dir pointing at /tmp", "/tmp", "", "/tmp/" + perUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", tt.runtimeDir)
+			t.Setenv("TMPDIR", tt.tmpDir)
+			if got := runtimeSocketPath(); got != tt.want {
+				t.Errorf("runtimeSocketPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClampBody(t *testing.T) {
+	const limit = bodyMaxMin
+	const suffix = "\n\n… (click to open full)"
+
+	if got := clampBody(strings.Repeat("word ", 500), 0); utf8.RuneCountInString(got) > bodyMaxChars+30 {
+		t.Errorf("clampBody(limit 0) kept %d runes, want the default limit", utf8.RuneCountInString(got))
+	}
+	if got := clampBody("  short  ", limit); got != "short" {
+		t.Errorf("clampBody(short) = %q, want it unchanged", got)
+	}
+	exact := strings.Repeat("é", limit)
+	if got := clampBody(exact, limit); got != exact {
+		t.Errorf("clampBody() cut %d runes of multi-byte text that fits", utf8.RuneCountInString(exact))
+	}
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "no spaces cuts on a rune",
+			in:   strings.Repeat("é", limit+1),
+			want: strings.Repeat("é", limit-80),
+		},
+		{
+			name: "word boundary",
+			in:   strings.Repeat("café ", 23) + "naïveté" + strings.Repeat(" x", 100), // "naïveté" straddles the cut
+			want: strings.TrimSpace(strings.Repeat("café ", 23)),
+		},
+		{
+			name: "sentence boundary",
+			in:   strings.Repeat("Ça va. ", 10) + "Voilà une phrase très longue " + strings.Repeat("où ", 50),
+			want: strings.TrimSpace(strings.Repeat("Ça va. ", 10)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := clampBody(tt.in, limit)
+			if !utf8.ValidString(got) {
+				t.Fatalf("clampBody() = %q, not valid UTF-8", got)
+			}
+			if got != tt.want+suffix {
+				t.Errorf("clampBody() =\n%q\nwant\n%q", got, tt.want+suffix)
+			}
+		})
+	}
+}
+
+func TestLRUStats(t *testing.T) {
+	c := newLRU(2, time.Hour)
+	c.set("a", diskEntry{Source: "online"})
+	c.set("b", diskEntry{Source: "online"})
+	c.get("a")
+	c.get("zzz")
+	c.set("c", diskEntry{Source: "online"}) // evicts b, the least recently used
+	if _, ok := c.get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	want := lruStats{Hits: 1, Misses: 2, Evictions: 1, Size: 2}
+	if got := c.stats(); got != want {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.lookup("memory")
+	m.lookup("fetch")
+	m.lookup("fetch")
+	m.source("online", "found", 80*time.Millisecond)
+	m.source("online", "error", 3*time.Second)
+	m.source("online", "skipped", 0)
+
+	var b strings.Builder
+	m.write(&b, lruStats{Hits: 4, Misses: 2, Size: 3})
+	out := b.String()
+	for _, want := range []string{
+		`define_lookups_total{answer="fetch"} 2`,
+		`define_lookups_total{answer="memory"} 1`,
+		`define_source_requests_total{source="online",result="skipped"} 1`,
+		`define_source_duration_seconds_bucket{source="online",le="0.05"} 0`,
+		`define_source_duration_seconds_bucket{source="online",le="0.1"} 1`,
+		`define_source_duration_seconds_bucket{source="online",le="5"} 2`,
+		`define_source_duration_seconds_count{source="online"} 2`,
+		`define_mem_cache_hits_total 4`,
+		`define_mem_cache_entries 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestSearchRows(t *testing.T) {
+	long := strings.Repeat("filler ", 20) + "the sloping land beside a River" + strings.Repeat(" more", 20)
+	rows := []exportRow{
+		{word: "bank", lang: "en", text: "bank\nnoun\n1. " + long},
+		{word: "run", lang: "en", text: "run\nverb\n1. To move swiftly."},
+		{word: "rive", lang: "fr", text: "rive\n1. Bord d'une river."},
+	}
+	hits := searchRows(rows, "  RIVER ")
+	if len(hits) != 2 || hits[0].word != "bank" || hits[1].lang != "fr" {
+		t.Fatalf("hits = %+v", hits)
+	}
+	sn := hits[0].snippet
+	if !strings.Contains(sn, "River") || !strings.HasPrefix(sn, "…") || !strings.HasSuffix(sn, "…") {
+		t.Fatalf("snippet = %q", sn)
+	}
+	if n := utf8.RuneCountInString(sn); n != searchSnippet+2 {
+		t.Fatalf("snippet is %d runes, want %d", n, searchSnippet+2)
+	}
+	if hits[1].snippet != "1. Bord d'une river." {
+		t.Fatalf("short line snippet = %q", hits[1].snippet)
+	}
+	if hits := searchRows(rows, " "); hits != nil {
+		t.Fatalf("blank query matched %+v", hits)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	old := "run\nverb\n1. To move swiftly.\nnoun\n1. An act of running."
+	cur := "run\nverb\n1. To move quickly.\nnoun\n1. An act of running."
+	got := strings.Join(lineDiff(old, cur), "|")
+	if want := "- 1. To move swiftly.|+ 1. To move quickly."; got != want {
+		t.Fatalf("lineDiff = %q, want %q", got, want)
+	}
+	if d := lineDiff(old, old); len(d) != 0 {
+		t.Fatalf("lineDiff of equal text = %q", d)
+	}
+	if got := strings.Join(lineDiff("a", "a\nb"), "|"); got != "+ b" {
+		t.Fatalf("appended line: %q", got)
+	}
+}
+
+func TestEntryPage(t *testing.T) {
+	tests := []struct {
+		lang string
+		de   diskEntry
+		want string
+	}{
+		{"en", diskEntry{Source: "online", Lemma: "run"}, "https://www.dictionary.com/browse/run"},
+		{"", diskEntry{Source: "mw", Lemma: "ice cream"}, "https://www.dictionary.com/browse/ice%20cream"},
+		{"en", diskEntry{Source: "wiktionary", Lemma: "ice cream"}, "https://en.wiktionary.org/wiki/ice_cream"},
+		{"fr", diskEntry{Source: "online", Lemma: "café"}, "https://en.wiktionary.org/wiki/caf%C3%A9"},
+	}
+	for _, tt := range tests {
+		if got := entryPage(tt.lang, tt.de); got != tt.want {
+			t.Errorf("entryPage(%q, %+v) = %q, want %q", tt.lang, tt.de, got, tt.want)
+		}
+	}
+}
+
+func TestListenUnixTakeover(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "d.sock")
+	ln, err := listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(sock); !errors.Is(err, errDaemonRunning) {
+		t.Fatalf("second listen on a live socket: %v, want errDaemonRunning", err)
+	}
+	// Closing a unix listener unlinks its file; put a dead one back.
+	_ = ln.Close()
+	if err := os.WriteFile(sock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ln, err = listenUnix(sock)
+	if err == nil {
+		_ = ln.Close()
+	}
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+}
+
+func TestMetricsListenAddr(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"9187", "127.0.0.1:9187", true},
+		{":9187", "127.0.0.1:9187", true},
+		{"localhost:9187", "127.0.0.1:9187", true},
+		{"[::1]:9187", "[::1]:9187", true},
+		{"0.0.0.0:9187", "", false},
+		{"example.com:9187", "", false},
+		{"127.0.0.1:99999", "", false},
+		{"nope", "", false},
+	}
+	for _, tt := range tests {
+		got, err := metricsListenAddr(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("metricsListenAddr(%q) = %q, %v; want %q, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLRUExpiresOnGet(t *testing.T) {
+	now := time.Now()
+	c := newLRU(8, time.Hour)
+	c.now = func() time.Time { return now }
+	c.set("en:run", diskEntry{Source: "online", TS: now})
+	c.set("en:xyzzy", diskEntry{Source: "none", TS: now})
+
+	now = now.Add(negativeTTL + time.Second)
+	if _, ok := c.get("en:run"); !ok {
+		t.Error("entry expired before the cache TTL")
+	}
+	if _, ok := c.get("en:xyzzy"); ok {
+		t.Error("negative entry outlived negativeTTL")
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := c.get("en:run"); ok {
+		t.Error("entry outlived the cache TTL")
+	}
+	if n := c.len(); n != 0 {
+		t.Errorf("expired entries left in the cache: len() = %d", n)
+	}
+}
+
+func TestDiskCacheFreshOffline(t *testing.T) {
+	t.Setenv("DEFINE_OFFLINE_REFRESH", "")
+	start := time.Now()
+	now := start
+	d := &diskCache{m: map[string]diskEntry{
+		"en:run": {Source: "offline", TS: start},
+	}, now: func() time.Time { return now }}
+
+	now = start.Add(offlineRefreshAfter - time.Minute)
+	if _, ok := d.fresh("en:run"); !ok {
+		t.Error("offline answer went stale before offlineRefreshAfter")
+	}
+	now = start.Add(offlineRefreshAfter + time.Minute)
+	if _, ok := d.fresh("en:run"); ok {
+		t.Error("offline answer still fresh after offlineRefreshAfter")
+	}
+	if _, ok := d.get("en:run"); !ok {
+		t.Error("fresh() should not drop the entry")
+	}
+}
+
+func TestDiskCacheCompact(t *testing.T) {
+	now := time.Now()
+	d := &diskCache{m: map[string]diskEntry{
+		"fresh":       {Source: "online", TS: now.Add(-time.Hour)},
+		"stale":       {Source: "online", TS: now.Add(-cacheTTL - time.Hour)},
+		"offline-new": {Source: "offline", TS: now.Add(-time.Hour)},
+		"offline-old": {Source: "offline", TS: now.Add(-offlineRefreshAfter - time.Hour)},
+		"none-old":    {Source: "none", TS: now.Add(-negativeTTL - time.Minute)},
+	}, now: time.Now}
+	if n := d.compact(); n != 3 {
+		t.Errorf("compact() = %d, want 3", n)
+	}
+	for _, k := range []string{"fresh", "offline-new"} {
+		if _, ok := d.m[k]; !ok {
+			t.Errorf("%s was pruned", k)
+		}
+	}
+	if !d.dirty {
+		t.Error("compact() should mark the cache dirty")
+	}
+}
+
+func TestDiskEntryTTLFromEnv(t *testing.T) {
+	tests := []struct {
+		ttl, refresh        string
+		wantOnline, wantOff time.Duration
+	}{
+		{"", "", cacheTTL, offlineRefreshAfter},
+		{"48h", "30m", 48 * time.Hour, 30 * time.Minute},
+		{"1s", "1s", cacheTTLMin, offlineRefreshMin}, // clamped up
+		{"100000h", "100000h", cacheTTLMax, cacheTTLMax},
+		{"soon", "-1h", cacheTTL, offlineRefreshAfter}, // invalid → default
+	}
+	for _, tt := range tests {
+		t.Setenv("DEFINE_CACHE_TTL", tt.ttl)
+		t.Setenv("DEFINE_OFFLINE_REFRESH", tt.refresh)
+		if got := diskEntryTTL("online"); got != tt.wantOnline {
+			t.Errorf("DEFINE_CACHE_TTL=%q: diskEntryTTL(online) = %v, want %v", tt.ttl, got, tt.wantOnline)
+		}
+		if got := diskEntryTTL("offline"); got != tt.wantOff {
+			t.Errorf("DEFINE_OFFLINE_REFRESH=%q: diskEntryTTL(offline) = %v, want %v", tt.refresh, got, tt.wantOff)
+		}
+	}
+}
+
+func TestPruneOldest(t *testing.T) {
+	now := time.Now()
+	m := map[string]diskEntry{
+		"a": {TS: now.Add(-3 * time.Hour)},
+		"b": {TS: now.Add(-1 * time.Hour)},
+		"c": {TS: now.Add(-4 * time.Hour)},
+		"d": {TS: now},
+	}
+	if n := pruneOldest(m, 2); n != 2 {
+		t.Errorf("pruneOldest() = %d, want 2", n)
+	}
+	if _, ok := m["b"]; !ok || len(m) != 2 || m["d"].TS != now {
+		t.Errorf("kept %v, want the two newest (b, d)", slices.Sorted(maps.Keys(m)))
+	}
+	if n := pruneOldest(m, 5); n != 0 {
+		t.Errorf("pruneOldest() under the cap = %d, want 0", n)
+	}
+}
+
+func TestLoadDiskCacheMigratesBareMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	old := `{"legend": {"title": "📘 Legend ☁️", "full": "A story.", "source": "online", "ts": "2026-01-02T03:04:05Z"},
+		"version": {"title": "📘 Version ☁️", "full": "A form.", "source": "online", "ts": "2026-01-02T03:04:05Z"}}`
+	if err := os.WriteFile(path, []byte(old), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := loadDiskCache(path)
+	if len(m) != 2 || m["legend"].Full != "A story." || m["version"].Full != "A form." {
+		t.Fatalf("loadDiskCache(old format) = %v", m)
+	}
+	if b, _ := os.ReadFile(path); string(b) != old {
+		t.Fatalf("loadDiskCache rewrote the file:\n%s", b)
+	}
+
+	// A diskCache rewrites it on its next flush, cache hit or not.
+	openDiskCache(path).flush()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, migrated, err := decodeDiskCache(b)
+	if err != nil || migrated {
+		t.Fatalf("file not rewritten in the versioned format: migrated=%v err=%v\n%s", migrated, err, b)
+	}
+	if !strings.Contains(string(b), `"version":1`) || len(got) != 2 || got["legend"].Source != "online" {
+		t.Errorf("rewritten file = %s", b)
+	}
+}
+
+func TestDiskCacheLeavesNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	newer := fmt.Sprintf(`{"version": %d, "entries": {"legend": {"full": "A story.", "source": "online"}}}`, cacheVersion+1)
+	if err := os.WriteFile(path, []byte(newer), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decodeDiskCache([]byte(newer)); !errors.Is(err, errCacheNewer) {
+		t.Fatalf("decodeDiskCache(newer) error = %v, want errCacheNewer", err)
+	}
+	if m := loadDiskCache(path); len(m) != 0 {
+		t.Fatalf("loadDiskCache(newer) = %v, want empty", m)
+	}
+
+	d := openDiskCache(path)
+	d.set("run", diskEntry{Full: "To move.", Source: "online", TS: time.Now()})
+	d.flush()
+	if b, _ := os.ReadFile(path); string(b) != newer {
+		t.Errorf("flush overwrote a newer cache.json:\n%s", b)
+	}
+}
+
+func TestLookupCustom(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	path := filepath.Join(dir, "define", "custom.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupCustom("kubelet"); err == nil {
+		t.Fatal("lookupCustom() without custom.json succeeded")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Kubelet": "The node agent.", "blank": " "}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lookupCustom("KUBELET"); err != nil || got != "The node agent." {
+		t.Errorf("lookupCustom() = %q, %v", got, err)
+	}
+	if _, err := lookupCustom("blank"); err == nil {
+		t.Error("lookupCustom() returned an empty definition")
+	}
+	if got := sourceNames(buildSources(lookupEnv{lang: "en"})); len(got) == 0 || got[0] != "custom" {
+		t.Errorf("buildSources() = %v, want custom first", got)
+	}
+
+	// An edit is picked up without a restart.
+	if err := os.WriteFile(path, []byte(`{"kubelet": "The agent on each node."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := lookupCustom("kubelet"); got != "The agent on each node." {
+		t.Errorf("lookupCustom() after an edit = %q", got)
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookmarks.jsonl")
+	now := time.Now()
+	for i, w := range []string{"Ephemeral", "run", "EPHEMERAL"} {
+		de := diskEntry{Title: w, Full: fmt.Sprint("def ", i), Source: "online"}
+		if err := addBookmark(path, w, de, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bms := loadBookmarks(path)
+	if len(bms) != 2 || bms[0].Word != "run" || bms[1].Word != "ephemeral" || bms[1].Full != "def 2" {
+		t.Fatalf("bookmarks = %+v, want run then the refreshed ephemeral", bms)
+	}
+
+	if i := nextReview(nil); i != -1 {
+		t.Errorf("nextReview(nil) = %d, want -1", i)
+	}
+	bms[0].Reviewed = now
+	if i := nextReview(bms); i != 1 {
+		t.Errorf("nextReview() = %d, want the unreviewed 1", i)
+	}
+	bms[1].Reviewed = now.Add(time.Hour)
+	if i := nextReview(bms); i != 0 {
+		t.Errorf("nextReview() = %d, want 0, reviewed longest ago", i)
+	}
+}
+
+func TestExportRows(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	now := time.Now()
+	saveDiskCacheAtomic(cacheFilePath(), map[string]diskEntry{
+		"run":          {Full: "to move fast", Source: "online", TS: now.Add(-time.Hour)},
+		"run#verb":     {Full: "to move fast", Source: "online", TS: now},
+		"es:hola":      {Full: "hello", Source: "wiktionary", TS: now.Add(-48 * time.Hour)},
+		"xyzzy":        {Full: "No definition found.", Source: "none", TS: now},
+		"old":          {Body: "<b><i>Old</i></b>\nnot &lt;new&gt;", Source: "offline", TS: now},
+		"walk+offline": {Full: "to go on foot", Source: "offline", TS: now},
+	})
+
+	words := func(rows []exportRow) []string {
+		var out []string
+		for _, r := range rows {
+			out = append(out, r.lang+":"+r.word)
+		}
+		return out
+	}
+	rows := exportRows(config{}, now)
+	if got, want := words(rows), []string{"es:hola", "en:old", "en:run"}; !slices.Equal(got, want) {
+		t.Errorf("exportRows() = %v, want %v", got, want)
+	}
+	if rows[1].text != "Old\nnot <new>" {
+		t.Errorf("text from the body = %q, want the markup stripped", rows[1].text)
+	}
+	if got := words(exportRows(config{exportSrcs: []string{"online", "wiktionary"}, since: 24 * time.Hour}, now)); !slices.Equal(got, []string{"en:run"}) {
+		t.Errorf("filtered exportRows() = %v, want [en:run]", got)
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	rows := []exportRow{{word: "r&b", lang: "en", source: "online", text: "a genre\n<music>\twith soul", ts: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}}
+
+	var anki strings.Builder
+	if err := writeExport(&anki, "anki", rows); err != nil {
+		t.Fatal(err)
+	}
+	if want := "#separator:tab\n#html:true\nr&amp;b\ta genre<br>&lt;music&gt; with soul\n"; anki.String() != want {
+		t.Errorf("anki export = %q, want %q", anki.String(), want)
+	}
+
+	var c strings.Builder
+	if err := writeExport(&c, "csv", rows); err != nil {
+		t.Fatal(err)
+	}
+	if want := "word,lang,source,definition,fetched\nr&b,en,online,\"a genre\n<music>\twith soul\",2026-01-02T03:04:05Z\n"; c.String() != want {
+		t.Errorf("csv export = %q, want %q", c.String(), want)
+	}
+}
+
+func TestRunREPL(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("XDG_CACHE_HOME", dir)
+	path := filepath.Join(dir, "define", "custom.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"kubelet": "The node agent.", "etcd": "A key-value store."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	in := strings.NewReader("kubelet\n  etcd, please\n:q\nkubelet\n")
+	var out strings.Builder
+	cfg := loadConfig()
+	cfg.offlineOnly = true
+	if code := runREPL(cfg, paths{}, in, &out); code != 0 {
+		t.Fatalf("runREPL() = %d", code)
+	}
+	got := out.String()
+	for _, want := range []string{"The node agent.", "A key-value store."} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output is missing %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, replSeparator); n != 2 {
+		t.Errorf("%d definitions printed, want 2 (stop at :q):\n%s", n, got)
+	}
+}
+
+func TestReadLast(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	if _, ok := readLast(); ok {
+		t.Fatal("readLast() with no file reported a lookup")
+	}
+
+	de := diskEntry{Title: "📘 Legend ☁️", Body: "<b><i>Legend</i></b>\nA story.", Full: "A story.", Source: "online"}
+	writeLast("legend", de)
+	want := lastLookup{Word: "legend", Title: de.Title, Body: de.Body, Full: de.Full, Source: "online"}
+	if got, ok := readLast(); !ok || got != want {
+		t.Errorf("readLast() = %+v, %v; want %+v", got, ok, want)
+	}
+
+	// last.txt from before it was JSON held only the full text.
+	if err := os.WriteFile(lastFilePath(), []byte("An old story."), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := readLast(); !ok || got != (lastLookup{Full: "An old story."}) {
+		t.Errorf("readLast(plain text) = %+v, %v", got, ok)
+	}
+}
+
+func TestRecordMiss(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	for _, w := range []string{"kubelet", "Kubelet", "machine learnt", "kubelet"} {
+		recordMiss(w)
+	}
+	if got, want := loadMisses(missesFilePath()), []string{"kubelet", "machine learnt"}; !slices.Equal(got, want) {
+		t.Errorf("misses = %q, want %q", got, want)
+	}
+
+	for i := range missesMax {
+		recordMiss(fmt.Sprintf("w%d", i))
+	}
+	got := loadMisses(missesFilePath())
+	if len(got) != missesMax || got[0] != "w0" || got[len(got)-1] != fmt.Sprintf("w%d", missesMax-1) { // the two oldest dropped
+		t.Errorf("capped misses = %d words, %q … %q", len(got), got[0], got[len(got)-1])
+	}
+}
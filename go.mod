@@ -2,6 +2,11 @@ module github.com/rayan6ms/define
 
 go 1.24.4
 
-require github.com/godbus/dbus/v5 v5.2.2
+require (
+	github.com/godbus/dbus/v5 v5.2.2
+	golang.org/x/sync v0.16.0
+	golang.org/x/text v0.27.0
+	golang.org/x/time v0.12.0
+)
 
 require golang.org/x/sys v0.27.0 // indirect
@@ -22,7 +22,7 @@ for t in "${targets[@]}"; do
 
   echo "Building $name..."
   env CGO_ENABLED=0 GOOS="$GOOS" GOARCH="$GOARCH" \
-    go build -trimpath -ldflags="-s -w" -o "$OUTDIR/$APP" ./...
+    go build -trimpath -ldflags="-s -w -X main.version=${VERSION}" -o "$OUTDIR/$APP" ./...
 
   ( cd "$OUTDIR" && tar -czf "${name}.tar.gz" "$APP" )
   rm -f "$OUTDIR/$APP"